@@ -0,0 +1,976 @@
+// Package client is an MQTT 3.1.1 client, built on the same packet codec as
+// the OrbMQ broker.
+//
+// A Client connects to a single server, publishes messages with QoS 0, 1 or
+// 2 and delivers the messages of its subscriptions to Go callbacks. It sends
+// keep-alive pings on its own and, unless told otherwise, reconnects when
+// the connection is lost, restoring its subscriptions and sending again the
+// messages the server had not acknowledged.
+package client
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+var (
+	// ErrNotConnected is returned by operations started before Connect
+	// succeeded, and by QoS 0 publishes while the client is reconnecting.
+	ErrNotConnected = errors.New("client is not connected")
+
+	// ErrAlreadyConnected is returned when Connect is called twice.
+	ErrAlreadyConnected = errors.New("client is already connected")
+
+	// ErrClosed is returned by operations on a client after Disconnect.
+	ErrClosed = errors.New("client is closed")
+
+	// ErrSubscriptionRefused is returned by Subscribe when the server
+	// refuses the subscription.
+	ErrSubscriptionRefused = errors.New("subscription refused by the server")
+
+	// ErrNoPacketID is returned when every packet identifier is taken by a
+	// request that has not been acknowledged yet.
+	ErrNoPacketID = errors.New("no packet identifier available")
+
+	// ErrPingTimeout ends a connection on which the server did not answer a
+	// PINGREQ within one keep-alive interval.
+	ErrPingTimeout = errors.New("server did not answer PINGREQ")
+
+	// ErrPacketTooLarge ends a connection on which the server sent a
+	// packet larger than the maximum packet size of the client.
+	ErrPacketTooLarge = protocol.ErrPacketTooLarge
+)
+
+// ConnectError is returned by Connect when the server refuses the
+// connection. ReturnCode is the return code of the CONNACK.
+type ConnectError struct {
+	ReturnCode byte
+}
+
+func (e *ConnectError) Error() string {
+	switch protocol.ConnAckReturnCode(e.ReturnCode) {
+	case protocol.ConnAckUnacceptableProtocolVersion:
+		return "connection refused: unacceptable protocol version"
+	case protocol.ConnAckIdentifierRejected:
+		return "connection refused: identifier rejected"
+	case protocol.ConnAckServerUnavailable:
+		return "connection refused: server unavailable"
+	case protocol.ConnAckBadUsernameOrPassword:
+		return "connection refused: bad username or password"
+	case protocol.ConnAckNotAuthorized:
+		return "connection refused: not authorized"
+	default:
+		return fmt.Sprintf("connection refused: return code %d", e.ReturnCode)
+	}
+}
+
+// Message is an application message, received from a subscription or
+// registered as a will.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+
+	// Duplicate is set when the server may have delivered the message
+	// before. It is only set on QoS 1 messages; QoS 2 messages are never
+	// delivered twice.
+	Duplicate bool
+}
+
+// MessageHandler is called with the messages matching a subscription.
+type MessageHandler func(msg Message)
+
+type Client struct {
+	addr string
+
+	clientID         string
+	username         *string
+	password         *string
+	cleanSession     bool
+	keepAlive        time.Duration
+	maxPacketSize    int
+	will             *Message
+	autoReconnect    bool
+	maxBackoff       time.Duration
+	dial             func(ctx context.Context) (net.Conn, error)
+	onConnect        func(sessionPresent bool)
+	onConnectionLost func(err error)
+
+	// queue holds the messages received from the server until the
+	// goroutine running the handlers gets to them. It is not bounded, so a
+	// handler may wait for the acknowledgement of a Publish without
+	// blocking the reading of that acknowledgement.
+	queueMu sync.Mutex
+	queue   []Message
+	queued  chan struct{}
+
+	// done is closed once the client is shut down, after err is set.
+	done         chan struct{}
+	err          error
+	shutdownOnce sync.Once
+
+	mu       sync.Mutex
+	started  bool
+	conn     *connection
+	nextID   uint16
+	seq      uint64
+	pending  map[uint16]*request
+	subs     map[string]subscription
+	received map[uint16]struct{}
+}
+
+// connection is a network connection to the server with the reader that
+// decodes its packets, the packets waiting to be written and its
+// keep-alive state.
+type connection struct {
+	net.Conn
+	r *protocol.Reader
+
+	// out holds the encoded packets waiting for the write loop. It is not
+	// bounded, so neither the read loop nor a caller holding c.mu waits
+	// for the server to read. Once closing is set, the write loop closes
+	// the connection after writing them.
+	outMu   sync.Mutex
+	out     [][]byte
+	closing bool
+	queued  chan struct{}
+
+	// done is closed with the connection, which stops the write loop.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	pingPending atomic.Bool
+	pingExpired atomic.Bool
+}
+
+// request is a packet that needs an acknowledgement from the server: a QoS
+// 1 or QoS 2 PUBLISH, a SUBSCRIBE or an UNSUBSCRIBE.
+//
+// pkt is the packet to send again after a reconnect; it becomes the PUBREL
+// once a QoS 2 message has been received by the server. seq records the
+// order of the requests, and done receives the final acknowledgement.
+type request struct {
+	pkt  protocol.Packet
+	seq  uint64
+	sent bool
+	done chan protocol.Packet
+}
+
+type subscription struct {
+	qos     byte
+	handler MessageHandler
+}
+
+// New returns a client for the server at addr, a "host:port" address. It
+// does not connect until Connect is called.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:          addr,
+		cleanSession:  true,
+		keepAlive:     DefaultKeepAlive,
+		maxPacketSize: DefaultMaxPacketSize,
+		autoReconnect: true,
+		maxBackoff:    DefaultMaxReconnectBackoff,
+		queued:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		pending:       make(map[uint16]*request),
+		subs:          make(map[string]subscription),
+		received:      make(map[uint16]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.dial == nil {
+		c.dial = func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", c.addr)
+		}
+	}
+
+	return c
+}
+
+// Connect connects to the server and returns once the server accepted the
+// connection. A refusal from the server is reported as a *ConnectError.
+//
+// After a successful Connect the client stays connected, or keeps trying
+// to reconnect, until Disconnect is called.
+func (c *Client) Connect(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return ErrAlreadyConnected
+	}
+	c.started = true
+	c.mu.Unlock()
+
+	conn, sessionPresent, err := c.connect(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.started = false
+		c.mu.Unlock()
+		return err
+	}
+
+	go c.dispatch()
+
+	if !c.attach(conn, sessionPresent) {
+		conn.close()
+		return ErrClosed
+	}
+	go c.run(conn)
+
+	return nil
+}
+
+// Publish sends a message to the server. QoS 1 and QoS 2 messages are
+// acknowledged by the server before Publish returns; QoS 0 messages are
+// only queued for the connection.
+//
+// If ctx is done before the acknowledgement arrives, Publish returns the
+// context error but the message is still delivered, and sent again after a
+// reconnect if needed.
+func (c *Client) Publish(ctx context.Context, name string, payload []byte, qos byte, retain bool) error {
+	if qos > 2 {
+		return errors.New("invalid QoS level")
+	}
+
+	pub := &protocol.PublishPacket{
+		Topic:   name,
+		Payload: payload,
+		QoS:     qos,
+		Retain:  retain,
+	}
+
+	if qos == 0 {
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+
+		if conn == nil {
+			return c.notConnected()
+		}
+		return conn.send(pub)
+	}
+
+	c.mu.Lock()
+	req, err := c.requestLocked(func(id uint16) protocol.Packet {
+		pub.PacketID = id
+		return pub
+	})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.wait(ctx, req)
+	return err
+}
+
+// Subscribe subscribes to a topic filter with the given maximum QoS and
+// returns the QoS granted by the server. Messages matching the filter are
+// passed to handler, including retained messages sent by the server right
+// after the subscription.
+//
+// Handlers run one at a time, in the order messages were received, on a
+// goroutine of the client. A message matching several filters is passed
+// to each of their handlers.
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler MessageHandler) (byte, error) {
+	c.mu.Lock()
+	prev, existed := c.subs[filter]
+	c.subs[filter] = subscription{qos: qos, handler: handler}
+
+	req, err := c.requestLocked(func(id uint16) protocol.Packet {
+		return &protocol.SubscribePacket{
+			PacketID:      id,
+			Subscriptions: []protocol.Subscription{{Topic: filter, QoS: qos}},
+		}
+	})
+	if err != nil {
+		c.restoreLocked(filter, prev, existed)
+		c.mu.Unlock()
+		return 0, err
+	}
+	c.mu.Unlock()
+
+	ack, err := c.wait(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	suback, ok := ack.(*protocol.SubAckPacket)
+	if !ok || len(suback.ReturnCodes) != 1 || suback.ReturnCodes[0] == 0x80 {
+		c.mu.Lock()
+		c.restoreLocked(filter, prev, existed)
+		c.mu.Unlock()
+		return 0, ErrSubscriptionRefused
+	}
+
+	return suback.ReturnCodes[0], nil
+}
+
+// Unsubscribe removes the subscriptions to the given topic filters. Their
+// handlers are not called anymore, even for messages already on their way.
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	req, err := c.requestLocked(func(id uint16) protocol.Packet {
+		return &protocol.UnsubscribePacket{
+			PacketID: id,
+			Topics:   filters,
+		}
+	})
+	if err == nil {
+		for _, filter := range filters {
+			delete(c.subs, filter)
+		}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.wait(ctx, req)
+	return err
+}
+
+// Disconnect sends a DISCONNECT to the server, so it discards the will,
+// and closes the connection. Pending operations fail with ErrClosed and
+// the client cannot be used anymore.
+func (c *Client) Disconnect() {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	c.shutdown(ErrClosed)
+
+	if conn != nil {
+		_ = conn.send(&protocol.DisconnectPacket{})
+		conn.closeWhenSent()
+	}
+}
+
+// Done returns a channel that is closed when the client shuts down, either
+// through Disconnect or because the connection was lost without automatic
+// reconnect. Err then reports why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the client shut down, or nil while it is running.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// connect dials the server and goes through the CONNECT handshake.
+func (c *Client) connect(ctx context.Context) (*connection, bool, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+	}
+
+	nc, err := c.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The handshake is bounded by ctx: its deadline applies to every read
+	// and write, and cancelling it interrupts them.
+	deadline, _ := ctx.Deadline()
+	_ = nc.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = nc.SetDeadline(time.Unix(1, 0))
+	})
+
+	conn := &connection{
+		Conn:   nc,
+		r:      protocol.NewReader(nc),
+		queued: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	conn.r.SetMaxPacketSize(c.maxPacketSize)
+	sessionPresent, err := c.handshake(conn)
+	if !stop() {
+		err = cmp.Or(err, ctx.Err())
+	}
+	if err != nil {
+		nc.Close()
+		return nil, false, err
+	}
+
+	_ = nc.SetDeadline(time.Time{})
+	go conn.writeLoop()
+	return conn, sessionPresent, nil
+}
+
+// handshake sends the CONNECT packet and reads the CONNACK. The write
+// loop is not running yet, so the CONNECT is written directly.
+func (c *Client) handshake(conn *connection) (bool, error) {
+	frame, err := encode(c.connectPacket())
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		return false, err
+	}
+
+	pkt, err := conn.r.ReadPacket()
+	if err != nil {
+		return false, err
+	}
+
+	connack, ok := pkt.(*protocol.ConnAckPacket)
+	if !ok {
+		return false, fmt.Errorf("expected CONNACK, got packet type %d", pkt.Type())
+	}
+
+	if connack.ReturnCode != protocol.ConnAckAccepted {
+		return false, &ConnectError{ReturnCode: byte(connack.ReturnCode)}
+	}
+
+	return connack.SessionPresent, nil
+}
+
+func (c *Client) connectPacket() *protocol.ConnectPacket {
+	pkt := &protocol.ConnectPacket{
+		CleanSession: c.cleanSession,
+		KeepAlive:    uint16(min(c.keepAlive/time.Second, 65535)),
+		ClientID:     c.clientID,
+		Username:     c.username,
+		Password:     c.password,
+	}
+
+	if c.will != nil {
+		pkt.WillFlag = true
+		pkt.WillTopic = c.will.Topic
+		pkt.WillMessage = c.will.Payload
+		pkt.WillQoS = c.will.QoS
+		pkt.WillRetain = c.will.Retain
+	}
+
+	return pkt
+}
+
+// attach makes conn the current connection. Requests still waiting for an
+// acknowledgement are sent again, in their original order, and when the
+// server did not keep the session the subscriptions are restored. It
+// returns false if the client was shut down in the meantime.
+func (c *Client) attach(conn *connection, sessionPresent bool) bool {
+	c.mu.Lock()
+
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return false
+	default:
+	}
+
+	c.conn = conn
+
+	reqs := make([]*request, 0, len(c.pending))
+	for _, req := range c.pending {
+		reqs = append(reqs, req)
+	}
+	slices.SortFunc(reqs, func(a, b *request) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	for _, req := range reqs {
+		if pub, ok := req.pkt.(*protocol.PublishPacket); ok {
+			pub.Dup = req.sent
+		}
+		_ = c.sendLocked(req)
+	}
+
+	if !sessionPresent {
+		// The server starts afresh, so QoS 2 messages it sent before are
+		// not going to be released.
+		clear(c.received)
+
+		for filter, sub := range c.subs {
+			_, _ = c.requestLocked(func(id uint16) protocol.Packet {
+				return &protocol.SubscribePacket{
+					PacketID:      id,
+					Subscriptions: []protocol.Subscription{{Topic: filter, QoS: sub.qos}},
+				}
+			})
+		}
+	}
+
+	c.mu.Unlock()
+
+	if c.onConnect != nil {
+		c.onConnect(sessionPresent)
+	}
+
+	return true
+}
+
+// run reads from conn until it fails, then reconnects if the client is
+// set up to, and starts over with the new connection.
+func (c *Client) run(conn *connection) {
+	for {
+		err := c.readLoop(conn)
+		conn.close()
+
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		if c.onConnectionLost != nil {
+			c.onConnectionLost(err)
+		}
+
+		if !c.autoReconnect {
+			c.shutdown(err)
+			return
+		}
+
+		var sessionPresent bool
+		if conn, sessionPresent = c.reconnect(); conn == nil {
+			return
+		}
+
+		if !c.attach(conn, sessionPresent) {
+			conn.close()
+			return
+		}
+	}
+}
+
+// reconnect tries to connect again, waiting longer after every failed
+// attempt, until it succeeds or the client is shut down.
+func (c *Client) reconnect() (*connection, bool) {
+	backoff := minReconnectBackoff
+
+	for {
+		select {
+		case <-c.done:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		// Disconnect interrupts the attempt.
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		go func() {
+			select {
+			case <-c.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		conn, sessionPresent, err := c.connect(ctx)
+		cancel()
+
+		if err == nil {
+			return conn, sessionPresent
+		}
+
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+// readLoop handles the packets received on conn until reading fails.
+func (c *Client) readLoop(conn *connection) error {
+	if c.keepAlive > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go c.pingLoop(conn, stop)
+	}
+
+	for {
+		pkt, err := conn.r.ReadPacket()
+		if err != nil {
+			if conn.pingExpired.Load() {
+				return ErrPingTimeout
+			}
+			return err
+		}
+
+		if err := c.handle(conn, pkt); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a packet received from the server.
+func (c *Client) handle(conn *connection, pkt protocol.Packet) error {
+	switch p := pkt.(type) {
+
+	case *protocol.PublishPacket:
+		msg := Message{
+			Topic:     p.Topic,
+			Payload:   p.Payload,
+			QoS:       p.QoS,
+			Retain:    p.Retain,
+			Duplicate: p.Dup,
+		}
+
+		switch p.QoS {
+		case 0:
+			c.deliver(msg)
+		case 1:
+			c.deliver(msg)
+			return conn.send(&protocol.PubAckPacket{PacketID: p.PacketID})
+		case 2:
+			// A retransmitted QoS 2 message is acknowledged again but
+			// delivered only once.
+			c.mu.Lock()
+			_, seen := c.received[p.PacketID]
+			c.received[p.PacketID] = struct{}{}
+			c.mu.Unlock()
+
+			if !seen {
+				msg.Duplicate = false
+				c.deliver(msg)
+			}
+			return conn.send(&protocol.PubRecPacket{PacketID: p.PacketID})
+		}
+
+	case *protocol.PubRelPacket:
+		c.mu.Lock()
+		delete(c.received, p.PacketID)
+		c.mu.Unlock()
+		return conn.send(&protocol.PubCompPacket{PacketID: p.PacketID})
+
+	case *protocol.PubRecPacket:
+		// From now on only the PUBREL is sent again after a reconnect.
+		c.mu.Lock()
+		if req, ok := c.pending[p.PacketID]; ok {
+			req.pkt = &protocol.PubRelPacket{PacketID: p.PacketID}
+		}
+		c.mu.Unlock()
+		return conn.send(&protocol.PubRelPacket{PacketID: p.PacketID})
+
+	case *protocol.PubAckPacket:
+		c.complete(p.PacketID, p)
+
+	case *protocol.PubCompPacket:
+		c.complete(p.PacketID, p)
+
+	case *protocol.SubAckPacket:
+		c.complete(p.PacketID, p)
+
+	case *protocol.UnsubAckPacket:
+		c.complete(p.PacketID, p)
+
+	case *protocol.PingRespPacket:
+		conn.pingPending.Store(false)
+
+	default:
+		return fmt.Errorf("unexpected packet type %d from server", pkt.Type())
+	}
+
+	return nil
+}
+
+// pingLoop sends a PINGREQ every keep-alive interval and closes conn when
+// the previous one was not answered in time.
+func (c *Client) pingLoop(conn *connection, stop chan struct{}) {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if conn.pingPending.Load() {
+			conn.pingExpired.Store(true)
+			conn.close()
+			return
+		}
+
+		conn.pingPending.Store(true)
+		if err := conn.send(&protocol.PingReqPacket{}); err != nil {
+			return
+		}
+	}
+}
+
+// deliver hands a received message to the dispatch goroutine.
+func (c *Client) deliver(msg Message) {
+	c.queueMu.Lock()
+	c.queue = append(c.queue, msg)
+	c.queueMu.Unlock()
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch passes received messages to the handlers of the subscriptions
+// they match, until the client is shut down.
+func (c *Client) dispatch() {
+	for {
+		select {
+		case <-c.queued:
+		case <-c.done:
+			return
+		}
+
+		c.queueMu.Lock()
+		msgs := c.queue
+		c.queue = nil
+		c.queueMu.Unlock()
+
+		for _, msg := range msgs {
+			for _, handler := range c.handlers(msg.Topic) {
+				handler(msg)
+			}
+		}
+	}
+}
+
+// handlers returns the handlers of every subscription matching the topic.
+func (c *Client) handlers(name string) []MessageHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var handlers []MessageHandler
+	for filter, sub := range c.subs {
+		if topic.MatchFilter(filter, name) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+
+	return handlers
+}
+
+// requestLocked allocates a packet identifier, builds the packet with it
+// and sends it if the client is connected. Otherwise it is sent once the
+// client reconnects. The caller must hold c.mu.
+func (c *Client) requestLocked(build func(id uint16) protocol.Packet) (*request, error) {
+	select {
+	case <-c.done:
+		return nil, c.err
+	default:
+	}
+
+	if !c.started {
+		return nil, c.notConnected()
+	}
+
+	id, ok := c.allocID()
+	if !ok {
+		return nil, ErrNoPacketID
+	}
+
+	req := &request{
+		pkt:  build(id),
+		seq:  c.seq,
+		done: make(chan protocol.Packet, 1),
+	}
+	if err := c.sendLocked(req); err != nil {
+		return nil, err
+	}
+
+	c.seq++
+	c.pending[id] = req
+	return req, nil
+}
+
+// sendLocked queues a request for the current connection, if any. A failed
+// write is left to the read loop, which notices the broken connection; the
+// request is sent again after the reconnect. It only fails when the packet
+// cannot be encoded. The caller must hold c.mu.
+func (c *Client) sendLocked(req *request) error {
+	if c.conn == nil {
+		return nil
+	}
+
+	if err := c.conn.send(req.pkt); err != nil {
+		return err
+	}
+
+	req.sent = true
+	return nil
+}
+
+// restoreLocked puts back the subscription to filter that was replaced by
+// a failed Subscribe. The caller must hold c.mu.
+func (c *Client) restoreLocked(filter string, prev subscription, existed bool) {
+	if existed {
+		c.subs[filter] = prev
+	} else {
+		delete(c.subs, filter)
+	}
+}
+
+// complete passes the final acknowledgement of a request to its waiter.
+func (c *Client) complete(packetID uint16, ack protocol.Packet) {
+	c.mu.Lock()
+	req, ok := c.pending[packetID]
+	delete(c.pending, packetID)
+	c.mu.Unlock()
+
+	if ok {
+		req.done <- ack
+	}
+}
+
+// wait waits for the final acknowledgement of a request.
+func (c *Client) wait(ctx context.Context, req *request) (protocol.Packet, error) {
+	select {
+	case ack := <-req.done:
+		return ack, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// allocID returns the next packet identifier that is not in use by a
+// pending request. Packet identifiers are non-zero, so 0 is skipped when
+// the counter wraps around. The caller must hold c.mu.
+func (c *Client) allocID() (uint16, bool) {
+	for range 65535 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+
+		if _, used := c.pending[c.nextID]; !used {
+			return c.nextID, true
+		}
+	}
+
+	return 0, false
+}
+
+// send queues a packet for the write loop.
+func (conn *connection) send(p protocol.Packet) error {
+	frame, err := encode(p)
+	if err != nil {
+		return err
+	}
+
+	conn.outMu.Lock()
+	conn.out = append(conn.out, frame)
+	conn.outMu.Unlock()
+
+	select {
+	case conn.queued <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// closeWhenSent closes the connection once the packets queued so far are
+// written, or after connectTimeout if the server stops reading.
+func (conn *connection) closeWhenSent() {
+	_ = conn.SetWriteDeadline(time.Now().Add(connectTimeout))
+
+	conn.outMu.Lock()
+	conn.closing = true
+	conn.outMu.Unlock()
+
+	select {
+	case conn.queued <- struct{}{}:
+	default:
+	}
+}
+
+// close closes the connection and stops its write loop.
+func (conn *connection) close() {
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		conn.Close()
+	})
+}
+
+// writeLoop writes the queued packets in order, until the connection is
+// closed or a write fails. A failed write closes the connection, so the
+// read loop notices it.
+func (conn *connection) writeLoop() {
+	for {
+		select {
+		case <-conn.queued:
+		case <-conn.done:
+			return
+		}
+
+		conn.outMu.Lock()
+		frames, closing := net.Buffers(conn.out), conn.closing
+		conn.out = nil
+		conn.outMu.Unlock()
+
+		if _, err := frames.WriteTo(conn.Conn); err != nil || closing {
+			conn.close()
+			return
+		}
+	}
+}
+
+// encode encodes a packet into a frame of its own.
+func encode(p protocol.Packet) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := protocol.Encode(&buf, p); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// notConnected returns the error for an operation that needs a connection.
+func (c *Client) notConnected() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return ErrNotConnected
+	}
+}
+
+// shutdown stops the client for good. Operations waiting for the server
+// fail with err.
+func (c *Client) shutdown(err error) {
+	c.shutdownOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
@@ -0,0 +1,307 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/broker"
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/server"
+)
+
+// startServer runs an in-process server on a random local port and
+// returns its address.
+func startServer(t *testing.T, opts ...server.Option) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.New("", broker.New(), opts...).Serve(ctx, ln)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return ln.Addr().String()
+}
+
+// connect returns a connected client that is disconnected at the end of
+// the test.
+func connect(t *testing.T, addr string, opts ...Option) *Client {
+	t.Helper()
+
+	c := New(addr, opts...)
+	require.NoError(t, c.Connect(context.Background()))
+	t.Cleanup(c.Disconnect)
+
+	return c
+}
+
+// inbox collects the messages passed to its handler.
+type inbox chan Message
+
+func (in inbox) handle(msg Message) {
+	in <- msg
+}
+
+func (in inbox) next(t *testing.T) Message {
+	t.Helper()
+
+	select {
+	case msg := <-in:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return Message{}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startServer(t)
+	ctx := context.Background()
+
+	sub := connect(t, addr, WithClientID("sub"))
+	pub := connect(t, addr, WithClientID("pub"))
+
+	in := make(inbox, 8)
+	granted, err := sub.Subscribe(ctx, "sensors/+", 2, in.handle)
+	require.NoError(t, err)
+	assert.Equal(t, byte(2), granted)
+
+	for qos := range byte(3) {
+		require.NoError(t, pub.Publish(ctx, "sensors/temp", []byte{'0' + qos}, qos, false))
+
+		msg := in.next(t)
+		assert.Equal(t, "sensors/temp", msg.Topic)
+		assert.Equal(t, []byte{'0' + qos}, msg.Payload)
+		assert.Equal(t, qos, msg.QoS)
+	}
+
+	require.NoError(t, sub.Unsubscribe(ctx, "sensors/+"))
+	require.NoError(t, pub.Publish(ctx, "sensors/temp", []byte("late"), 1, false))
+
+	select {
+	case msg := <-in:
+		t.Fatalf("unexpected message after unsubscribe: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRetainedOnSubscribe(t *testing.T) {
+	addr := startServer(t)
+	ctx := context.Background()
+
+	pub := connect(t, addr)
+	require.NoError(t, pub.Publish(ctx, "status/dev", []byte("online"), 1, true))
+
+	in := make(inbox, 1)
+	sub := connect(t, addr)
+	_, err := sub.Subscribe(ctx, "status/#", 1, in.handle)
+	require.NoError(t, err)
+
+	msg := in.next(t)
+	assert.Equal(t, "online", string(msg.Payload))
+	assert.True(t, msg.Retain)
+}
+
+func TestConnectRefused(t *testing.T) {
+	addr := startServer(t, server.WithAuthenticator(server.AuthenticatorFunc(
+		func(connect *protocol.ConnectPacket) error {
+			if connect.Username == nil || *connect.Username != "alice" {
+				return server.ErrBadCredentials
+			}
+			return nil
+		},
+	)))
+
+	err := New(addr, WithCredentials("bob", "secret")).Connect(context.Background())
+
+	var refused *ConnectError
+	require.ErrorAs(t, err, &refused)
+	assert.Equal(t, byte(protocol.ConnAckBadUsernameOrPassword), refused.ReturnCode)
+
+	c := connect(t, addr, WithCredentials("alice", "secret"))
+	assert.NoError(t, c.Publish(context.Background(), "a", nil, 0, false))
+}
+
+// breakableDialer dials addr and keeps the last connection, so a test can
+// break it.
+type breakableDialer struct {
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (d *breakableDialer) dial(ctx context.Context) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	return conn, nil
+}
+
+func (d *breakableDialer) breakConn() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conn.Close()
+}
+
+func TestReconnectResubscribes(t *testing.T) {
+	addr := startServer(t)
+	ctx := context.Background()
+
+	connected := make(chan bool, 4)
+	d := &breakableDialer{addr: addr}
+	sub := connect(t, addr,
+		WithClientID("sub"),
+		WithDialer(d.dial),
+		WithOnConnect(func(sessionPresent bool) { connected <- sessionPresent }),
+	)
+	<-connected
+
+	in := make(inbox, 8)
+	_, err := sub.Subscribe(ctx, "cmd/#", 1, in.handle)
+	require.NoError(t, err)
+
+	d.breakConn()
+
+	select {
+	case sessionPresent := <-connected:
+		assert.False(t, sessionPresent)
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+
+	// The SUBSCRIBE sent on reconnect is in flight; a QoS 1 round trip
+	// on the same connection orders it before the publish below.
+	require.NoError(t, sub.Publish(ctx, "noop", nil, 1, false))
+
+	pub := connect(t, addr)
+	require.NoError(t, pub.Publish(ctx, "cmd/reboot", []byte("now"), 1, false))
+	assert.Equal(t, "cmd/reboot", in.next(t).Topic)
+}
+
+func TestKeepAlive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for two keep-alive intervals")
+	}
+
+	addr := startServer(t)
+
+	lost := make(chan error, 1)
+	c := connect(t, addr,
+		WithKeepAlive(time.Second),
+		WithOnConnectionLost(func(err error) { lost <- err }),
+	)
+
+	// The server drops clients that stay silent for 1.5 keep-alive
+	// intervals; the pings keep this one connected.
+	select {
+	case err := <-lost:
+		t.Fatalf("connection lost: %v", err)
+	case <-time.After(2500 * time.Millisecond):
+	}
+
+	assert.NoError(t, c.Publish(context.Background(), "a", nil, 1, false))
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	addr := startServer(t)
+	ctx := context.Background()
+
+	lost := make(chan error, 1)
+	sub := connect(t, addr,
+		WithMaxPacketSize(64),
+		WithAutoReconnect(false),
+		WithOnConnectionLost(func(err error) { lost <- err }),
+	)
+	_, err := sub.Subscribe(ctx, "a", 0, func(Message) {})
+	require.NoError(t, err)
+
+	pub := connect(t, addr)
+	require.NoError(t, pub.Publish(ctx, "a", make([]byte, 100), 0, false))
+
+	select {
+	case err := <-lost:
+		assert.ErrorIs(t, err, ErrPacketTooLarge)
+	case <-time.After(2 * time.Second):
+		t.Fatal("oversized packet accepted")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	addr := startServer(t)
+
+	c := connect(t, addr)
+	c.Disconnect()
+
+	<-c.Done()
+	assert.ErrorIs(t, c.Err(), ErrClosed)
+	assert.ErrorIs(t, c.Publish(context.Background(), "a", nil, 1, false), ErrClosed)
+	assert.ErrorIs(t, c.Connect(context.Background()), ErrClosed)
+}
+
+func TestServerNotReading(t *testing.T) {
+	srv, cli := net.Pipe()
+	t.Cleanup(func() { srv.Close() })
+
+	c := New("", WithKeepAlive(0), WithDialer(func(context.Context) (net.Conn, error) {
+		return cli, nil
+	}))
+	t.Cleanup(c.Disconnect)
+
+	// The server answers the handshake and the SUBSCRIBE, then stops
+	// reading.
+	r := protocol.NewReader(srv)
+	go func() {
+		if _, err := r.ReadPacket(); err != nil {
+			return
+		}
+		_ = protocol.Encode(srv, &protocol.ConnAckPacket{})
+
+		pkt, err := r.ReadPacket()
+		sub, ok := pkt.(*protocol.SubscribePacket)
+		if err != nil || !ok {
+			return
+		}
+		_ = protocol.Encode(srv, &protocol.SubAckPacket{PacketID: sub.PacketID, ReturnCodes: []byte{2}})
+	}()
+
+	ctx := context.Background()
+	require.NoError(t, c.Connect(ctx))
+	in := make(inbox, 1)
+	_, err := c.Subscribe(ctx, "cmd/#", 2, in.handle)
+	require.NoError(t, err)
+
+	// Nothing reads this PUBLISH, nor the PUBREC of the message below.
+	go func() { _ = c.Publish(ctx, "state", []byte("on"), 1, false) }()
+
+	require.NoError(t, protocol.Encode(srv, &protocol.PublishPacket{
+		Topic:    "cmd/reboot",
+		Payload:  []byte("now"),
+		QoS:      2,
+		PacketID: 1,
+	}))
+	assert.Equal(t, "cmd/reboot", in.next(t).Topic, "the client keeps reading while its writes are stuck")
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultKeepAlive is the keep-alive interval used unless WithKeepAlive
+	// is given.
+	DefaultKeepAlive = 30 * time.Second
+
+	// DefaultMaxPacketSize is the largest packet accepted from the server
+	// unless WithMaxPacketSize is given.
+	DefaultMaxPacketSize = 16 << 20
+
+	// DefaultMaxReconnectBackoff is the longest wait between two reconnect
+	// attempts unless WithMaxReconnectBackoff is given.
+	DefaultMaxReconnectBackoff = 30 * time.Second
+
+	// minReconnectBackoff is the wait before the first reconnect attempt.
+	// It doubles after every failed attempt.
+	minReconnectBackoff = 100 * time.Millisecond
+
+	// connectTimeout bounds the time to get a CONNACK when the context
+	// passed to Connect has no deadline, and on reconnects.
+	connectTimeout = 10 * time.Second
+)
+
+// Option configures optional behavior of a Client.
+type Option func(*Client)
+
+// WithClientID sets the client identifier. Without it the client connects
+// with an empty one and the server assigns it an identifier, which only
+// works with a clean session.
+func WithClientID(id string) Option {
+	return func(c *Client) {
+		c.clientID = id
+	}
+}
+
+// WithCredentials makes the client authenticate with the given username
+// and password.
+func WithCredentials(username, password string) Option {
+	return func(c *Client) {
+		c.username = &username
+		c.password = &password
+	}
+}
+
+// WithCleanSession sets the clean session flag sent in CONNECT. It is set
+// by default; without it the server keeps the subscriptions and undelivered
+// messages of the client while it is disconnected.
+func WithCleanSession(clean bool) Option {
+	return func(c *Client) {
+		c.cleanSession = clean
+	}
+}
+
+// WithKeepAlive sets the keep-alive interval, which is rounded down to
+// whole seconds. The client sends a PINGREQ every interval and drops the
+// connection if the previous one was not answered. Zero disables
+// keep-alive.
+func WithKeepAlive(keepAlive time.Duration) Option {
+	return func(c *Client) {
+		c.keepAlive = keepAlive.Truncate(time.Second)
+	}
+}
+
+// WithMaxPacketSize limits the size of packets accepted from the server,
+// fixed header included. A larger packet ends the connection with
+// ErrPacketTooLarge before it is read into memory: MQTT 3.1.1 has no way
+// to tell the server about the limit. Zero only applies the protocol limit
+// of 256 MB.
+func WithMaxPacketSize(size int) Option {
+	return func(c *Client) {
+		c.maxPacketSize = size
+	}
+}
+
+// WithWill registers a will message, which the server publishes if the
+// connection ends without a call to Disconnect.
+func WithWill(topic string, payload []byte, qos byte, retain bool) Option {
+	return func(c *Client) {
+		c.will = &Message{
+			Topic:   topic,
+			Payload: payload,
+			QoS:     qos,
+			Retain:  retain,
+		}
+	}
+}
+
+// WithAutoReconnect sets whether the client reconnects when the connection
+// is lost, which it does by default. Subscriptions are restored and
+// unacknowledged messages are sent again on the new connection.
+func WithAutoReconnect(enabled bool) Option {
+	return func(c *Client) {
+		c.autoReconnect = enabled
+	}
+}
+
+// WithMaxReconnectBackoff caps the wait between two reconnect attempts.
+func WithMaxReconnectBackoff(max time.Duration) Option {
+	return func(c *Client) {
+		c.maxBackoff = max
+	}
+}
+
+// WithDialer replaces the TCP dialer used to reach the server, for example
+// to connect over TLS.
+func WithDialer(dial func(ctx context.Context) (net.Conn, error)) Option {
+	return func(c *Client) {
+		c.dial = dial
+	}
+}
+
+// WithOnConnect registers a function called every time the client is
+// connected, including after a reconnect, with the session present flag of
+// the CONNACK.
+func WithOnConnect(f func(sessionPresent bool)) Option {
+	return func(c *Client) {
+		c.onConnect = f
+	}
+}
+
+// WithOnConnectionLost registers a function called with the error that
+// ended a connection, before the client tries to reconnect.
+func WithOnConnectionLost(f func(err error)) Option {
+	return func(c *Client) {
+		c.onConnectionLost = f
+	}
+}
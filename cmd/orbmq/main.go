@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -12,6 +13,10 @@ import (
 )
 
 func main() {
+	maxPacketSize := flag.Int("max-packet-size", 0,
+		"largest packet accepted from clients, in bytes (0 means no limit but the protocol's 256 MB)")
+	flag.Parse()
+
 	ctx, stop := signal.NotifyContext(
 		context.Background(),
 		os.Interrupt,
@@ -20,7 +25,7 @@ func main() {
 	defer stop()
 
 	broker := broker.New()
-	srv := server.New(":1883", broker)
+	srv := server.New(":1883", broker, server.WithMaxPacketSize(*maxPacketSize))
 
 	go func() {
 		if err := srv.Start(ctx); err != nil {
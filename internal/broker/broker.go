@@ -1,18 +1,37 @@
 package broker
 
 import (
+	"log"
+	"slices"
+	"sync"
 	"sync/atomic"
 
-	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
 	"github.com/lucasmendoncca/OrbMQ/internal/topic"
 )
 
 type Broker struct {
 	topics atomic.Value
+
+	// treeMu serializes the copy-on-write updates of topics, so concurrent
+	// subscription changes cannot overwrite each other. Readers never take it.
+	treeMu sync.Mutex
+
+	retained *retainedStore
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+
+	sharedStrategy SharedStrategy
 }
 
-func New() *Broker {
-	b := &Broker{}
+func New(opts ...Option) *Broker {
+	b := &Broker{
+		retained: newRetainedStore(),
+		sessions: make(map[string]*session),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
 	b.topics.Store(topic.NewTree())
 	return b
 }
@@ -24,34 +43,120 @@ func New() *Broker {
 // A client can subscribe to multiple topics by calling Subscribe multiple times.
 // If a client is already subscribed to a topic, calling Subscribe again will not
 // cause the client to receive duplicate messages.
-func (b *Broker) Subscribe(filter string, sub topic.Subscriber) {
-	oldTree := b.topics.Load().(*topic.Tree)
+//
+// The qos argument is the maximum QoS granted for the subscription; messages
+// published with a higher QoS are downgraded when delivered to it.
+//
+// A filter of the form "$share/{group}/{filter}" joins a shared
+// subscription: each message matching the filter goes to a single member
+// of the group, picked by the broker's SharedStrategy.
+//
+// Every retained message whose topic matches the filter is delivered to the
+// subscriber right away, with the RETAIN flag set. Shared subscriptions do
+// not receive retained messages.
+func (b *Broker) Subscribe(filter string, sub topic.Subscriber, qos byte) {
+	b.SubscribeWith(filter, topic.Subscription{Subscriber: sub, QoS: qos})
+}
 
-	newTree := oldTree.Clone()
-	newTree.Subscribe(filter, sub)
+// SubscribeWith is like Subscribe, for a subscription with MQTT 5 options.
+// Its retain handling decides whether retained messages are delivered: on
+// every subscribe (0), only when the subscription is new (1), or never (2).
+func (b *Broker) SubscribeWith(filter string, s topic.Subscription) {
+	isNew := b.subscribe(filter, s)
 
-	b.topics.Store(newTree)
+	if group, _, _ := topic.ParseShared(filter); group != "" {
+		return
+	}
+	if s.RetainHandling == 2 || (s.RetainHandling == 1 && !isNew) {
+		return
+	}
+
+	for _, msg := range b.retained.match(filter) {
+		deliverRetained(s, msg)
+	}
 }
 
 // Publish sends a message to all clients subscribed to topics that match the
-// given PublishPacket's topic name.
-func (b *Broker) Publish(pub *protocol.PublishPacket, raw []byte) {
+// message's topic name.
+//
+// If the RETAIN flag is set, the message also replaces the retained message of
+// its topic, or deletes it when the payload is empty. Current subscribers
+// receive it with the RETAIN flag cleared, unless they asked for Retain As
+// Published. Subscriptions with No Local skip the messages of their own
+// client.
+//
+// Every subscriber receives the message decoded, downgraded to the QoS
+// granted to its subscription. The QoS 0 frame sent to network clients is
+// encoded once, by the first of them, and shared with the others. Shared
+// subscriptions deliver the message to one member of each group.
+//
+// A subscriber whose subscriptions with an identifier overlap receives a
+// single copy of the message from them, with every identifier, at the
+// highest QoS they grant.
+func (b *Broker) Publish(msg topic.Message) {
+	if msg.Retain {
+		b.retained.set(msg)
+	}
+
+	p := publication{live: msg}
+	p.live.Retain = false
+	p.live.ShareFrame()
+
+	// The RETAIN flag is part of the shared frame, so the messages kept
+	// retained have frames of their own.
+	p.asPublished = p.live
+	if msg.Retain {
+		p.asPublished = msg
+		p.asPublished.ShareFrame()
+	}
+
 	tree := b.topics.Load().(*topic.Tree)
-	subs := tree.Match(pub.Topic)
+	subs, groups := tree.MatchAll(msg.Topic)
 
+	var identified []topic.Subscription
 	for _, sub := range subs {
-		if err := sub.Enqueue(raw); err != nil {
-			// TODO: metrics / disconnect slow client
+		if sub.Identifier != 0 {
+			identified = append(identified, sub)
+			continue
 		}
+		p.deliver(sub)
+	}
+	if len(identified) > 0 {
+		p.deliverIdentified(identified)
+	}
+
+	for _, g := range groups {
+		p.deliver(b.pick(g, &msg))
 	}
 
 	topic.PutSubs(subs)
 }
 
+// Unsubscribe removes the subscription of the given clientID to exactly the
+// given filter, leaving the client's other subscriptions in place.
+// It reports whether the client was subscribed to the filter.
+func (b *Broker) Unsubscribe(filter string, clientID string) bool {
+	b.treeMu.Lock()
+	defer b.treeMu.Unlock()
+
+	oldTree := b.topics.Load().(*topic.Tree)
+
+	newTree := oldTree.Clone()
+	if !newTree.Unsubscribe(filter, clientID) {
+		return false
+	}
+
+	b.topics.Store(newTree)
+	return true
+}
+
 // UnsubscribeAll removes all subscriptions for the given clientID from the broker.
 // It is used by the Broker's UnsubscribeAll function to remove all subscriptions
 // for a client when the client disconnects.
 func (b *Broker) UnsubscribeAll(clientID string) {
+	b.treeMu.Lock()
+	defer b.treeMu.Unlock()
+
 	oldTree := b.topics.Load().(*topic.Tree)
 
 	newTree := oldTree.Clone()
@@ -59,3 +164,112 @@ func (b *Broker) UnsubscribeAll(clientID string) {
 
 	b.topics.Store(newTree)
 }
+
+// subscribe adds the subscription to a copy of the topic tree and makes the
+// copy visible to publishers. It reports whether the subscription is new.
+func (b *Broker) subscribe(filter string, s topic.Subscription) bool {
+	b.treeMu.Lock()
+	defer b.treeMu.Unlock()
+
+	oldTree := b.topics.Load().(*topic.Tree)
+
+	newTree := oldTree.Clone()
+	isNew := newTree.Subscribe(filter, s)
+
+	b.topics.Store(newTree)
+	return isNew
+}
+
+// publication is a message being published, in the two forms subscribers
+// receive it: with the RETAIN flag cleared, or as published.
+type publication struct {
+	live        topic.Message
+	asPublished topic.Message
+}
+
+// deliver hands the message to a subscription, according to its options.
+func (p *publication) deliver(sub topic.Subscription) {
+	if p.local(sub) {
+		return
+	}
+
+	if sub.RetainAsPublished {
+		deliver(sub, p.asPublished)
+		return
+	}
+	deliver(sub, p.live)
+}
+
+// deliverIdentified hands the message to subscriptions with an identifier,
+// once per subscriber. The copy carries the identifiers of all the
+// subscriptions of the subscriber, the highest QoS they grant, and the
+// RETAIN flag as published if any of them asked for it.
+func (p *publication) deliverIdentified(subs []topic.Subscription) {
+	type merged struct {
+		sub topic.Subscription
+		ids []uint32
+	}
+
+	var order []*merged
+	bySubscriber := make(map[string]*merged, len(subs))
+	for _, sub := range subs {
+		if p.local(sub) {
+			continue
+		}
+
+		m := bySubscriber[sub.Subscriber.ID()]
+		if m == nil {
+			m = &merged{sub: sub}
+			bySubscriber[sub.Subscriber.ID()] = m
+			order = append(order, m)
+		} else {
+			m.sub.QoS = max(m.sub.QoS, sub.QoS)
+			m.sub.RetainAsPublished = m.sub.RetainAsPublished || sub.RetainAsPublished
+		}
+		m.ids = append(m.ids, sub.Identifier)
+	}
+
+	for _, m := range order {
+		msg := p.live
+		if m.sub.RetainAsPublished {
+			msg = p.asPublished
+		}
+		slices.Sort(m.ids)
+		msg.SubscriptionIdentifiers = m.ids
+		msg.QoS = min(msg.QoS, m.sub.QoS)
+
+		handOver(m.sub.Subscriber, msg)
+	}
+}
+
+// local reports whether the message was published by the client of a
+// subscription with No Local, which must not receive it.
+func (p *publication) local(sub topic.Subscription) bool {
+	return sub.NoLocal && p.live.From != "" && p.live.From == sub.Subscriber.ID()
+}
+
+// deliver hands a published message to a single subscription, downgrading
+// it to the QoS granted for that subscription and adding its identifier.
+func deliver(sub topic.Subscription, msg topic.Message) {
+	msg.QoS = min(msg.QoS, sub.QoS)
+	if sub.Identifier != 0 {
+		msg.SubscriptionIdentifiers = []uint32{sub.Identifier}
+	}
+	handOver(sub.Subscriber, msg)
+}
+
+// deliverRetained sends a retained message to a new subscription,
+// downgraded to the QoS granted for it, with the RETAIN flag set.
+func deliverRetained(sub topic.Subscription, msg topic.Message) {
+	msg.Retain = true
+	deliver(sub, msg)
+}
+
+// handOver passes a message to a subscriber. A subscriber that cannot take
+// it, such as a client whose queue is full, misses the message, and the
+// drop is logged.
+func handOver(s topic.Subscriber, msg topic.Message) {
+	if err := s.Deliver(msg); err != nil {
+		log.Printf("dropping message on %s for %s: %v", msg.Topic, s.ID(), err)
+	}
+}
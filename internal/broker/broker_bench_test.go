@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
 )
 
 type mockSub struct {
@@ -14,8 +15,10 @@ func (m *mockSub) ID() string {
 	return m.id
 }
 
-func (m *mockSub) Enqueue(_ []byte) error {
-	return nil
+// Deliver asks for the encoded frame, like a network client would.
+func (m *mockSub) Deliver(msg topic.Message) error {
+	_, err := msg.Frame(protocol.Version311)
+	return err
 }
 
 func setupBroker(numSubs int) *Broker {
@@ -24,7 +27,7 @@ func setupBroker(numSubs int) *Broker {
 	sub := &mockSub{id: "sub-1"}
 
 	for i := 0; i < numSubs; i++ {
-		b.Subscribe("sensors/+", sub)
+		b.Subscribe("sensors/+", sub, 0)
 	}
 
 	return b
@@ -33,52 +36,46 @@ func setupBroker(numSubs int) *Broker {
 func BenchmarkBrokerPublish(b *testing.B) {
 	broker := setupBroker(1)
 
-	pub := &protocol.PublishPacket{
+	msg := topic.Message{
 		Topic:   "sensors/temp",
 		Payload: []byte("25.3"),
 	}
 
-	raw := []byte("fake-mqtt-publish")
-
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		broker.Publish(pub, raw)
+		broker.Publish(msg)
 	}
 }
 
 func BenchmarkBrokerPublish_10Subs(b *testing.B) {
 	broker := setupBroker(10)
 
-	pub := &protocol.PublishPacket{
+	msg := topic.Message{
 		Topic:   "sensors/temp",
 		Payload: []byte("25.3"),
 	}
 
-	raw := []byte("fake-mqtt-publish")
-
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		broker.Publish(pub, raw)
+		broker.Publish(msg)
 	}
 }
 
 func BenchmarkBrokerPublish_Parallel(b *testing.B) {
 	broker := setupBroker(10)
 
-	pub := &protocol.PublishPacket{
+	msg := topic.Message{
 		Topic:   "sensors/temp",
 		Payload: []byte("25.3"),
 	}
 
-	raw := []byte("fake-mqtt-publish")
-
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			broker.Publish(pub, raw)
+			broker.Publish(msg)
 		}
 	})
 }
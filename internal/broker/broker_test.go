@@ -0,0 +1,447 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/client"
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// recordingSub records every message it receives.
+type recordingSub struct {
+	id   string
+	msgs []topic.Message
+}
+
+func (r *recordingSub) ID() string {
+	return r.id
+}
+
+func (r *recordingSub) Deliver(msg topic.Message) error {
+	r.msgs = append(r.msgs, msg)
+	return nil
+}
+
+func TestRetainedMessages(t *testing.T) {
+	b := New()
+
+	b.Publish(topic.Message{Topic: "sensors/1/temp", Payload: []byte("20"), Retain: true})
+	b.Publish(topic.Message{Topic: "sensors/1/temp", Payload: []byte("21"), QoS: 1, Retain: true})
+	b.Publish(topic.Message{Topic: "sensors/2/temp", Payload: []byte("19"), Retain: true})
+	b.Publish(topic.Message{Topic: "sensors/3/temp", Payload: []byte("18"), Retain: true})
+	b.Publish(topic.Message{Topic: "sensors/3/temp", Payload: nil, Retain: true})
+	b.Publish(topic.Message{Topic: "sensors/4/temp", Payload: []byte("live")})
+
+	t.Run("wildcard filter", func(t *testing.T) {
+		sub := &recordingSub{id: "a"}
+		b.Subscribe("sensors/+/temp", sub, 0)
+
+		require.Len(t, sub.msgs, 2)
+		got := map[string]string{}
+		for _, msg := range sub.msgs {
+			assert.True(t, msg.Retain)
+			assert.Equal(t, byte(0), msg.QoS)
+			got[msg.Topic] = string(msg.Payload)
+		}
+		assert.Equal(t, map[string]string{"sensors/1/temp": "21", "sensors/2/temp": "19"}, got)
+	})
+
+	t.Run("QoS is the minimum of message and subscription", func(t *testing.T) {
+		sub := &recordingSub{id: "b"}
+		b.Subscribe("sensors/1/#", sub, 2)
+
+		require.Len(t, sub.msgs, 1)
+		assert.Equal(t, byte(1), sub.msgs[0].QoS)
+		assert.True(t, sub.msgs[0].Retain)
+	})
+
+	t.Run("live delivery clears the retain flag", func(t *testing.T) {
+		sub := &recordingSub{id: "c"}
+		b.Subscribe("live/#", sub, 1)
+		b.Publish(topic.Message{Topic: "live/x", Payload: []byte("1"), QoS: 1, Retain: true})
+
+		require.Len(t, sub.msgs, 1)
+		assert.False(t, sub.msgs[0].Retain)
+	})
+}
+
+func TestDollarTopics(t *testing.T) {
+	b := New()
+	b.Publish(topic.Message{Topic: "$SYS/uptime", Payload: []byte("1"), Retain: true})
+
+	all := &recordingSub{id: "all"}
+	b.Subscribe("#", all, 0)
+	sys := &recordingSub{id: "sys"}
+	b.Subscribe("$SYS/#", sys, 0)
+
+	b.Publish(topic.Message{Topic: "$SYS/uptime", Payload: []byte("2")})
+	b.Publish(topic.Message{Topic: "status", Payload: []byte("3")})
+
+	require.Len(t, all.msgs, 1, "# matches neither retained nor live $ topics")
+	assert.Equal(t, "status", all.msgs[0].Topic)
+
+	require.Len(t, sys.msgs, 2)
+	assert.True(t, sys.msgs[0].Retain)
+	assert.Equal(t, "2", string(sys.msgs[1].Payload))
+}
+
+func TestSessions(t *testing.T) {
+	b := New()
+
+	cli, present := b.OpenSession("dev", false, NeverExpire)
+	assert.False(t, present)
+	b.Subscribe("cmd/#", cli, 1)
+	b.CloseSession(cli)
+
+	resumed, present := b.OpenSession("dev", false, NeverExpire)
+	assert.True(t, present)
+	assert.Same(t, cli, resumed)
+	assert.Len(t, matches(b, "cmd/reboot"), 1, "subscriptions survive a persistent session")
+	b.CloseSession(resumed)
+
+	fresh, present := b.OpenSession("dev", true, 0)
+	assert.False(t, present)
+	assert.NotSame(t, cli, fresh)
+	assert.Empty(t, matches(b, "cmd/reboot"), "a clean session drops the old subscriptions")
+
+	b.Subscribe("cmd/#", fresh, 0)
+	b.CloseSession(fresh)
+	assert.Empty(t, matches(b, "cmd/reboot"), "a clean session ends with its connection")
+
+	_, present = b.OpenSession("dev", false, NeverExpire)
+	assert.False(t, present)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	b := New()
+
+	cli, _ := b.OpenSession("dev", false, 1)
+	b.Subscribe("cmd/#", cli, 1)
+	b.CloseSession(cli)
+
+	resumed, present := b.OpenSession("dev", false, 1)
+	require.True(t, present)
+	b.CloseSession(resumed)
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.Empty(t, matches(b, "cmd/reboot"), "expired sessions lose their subscriptions")
+	_, present = b.OpenSession("dev", false, 1)
+	assert.False(t, present)
+
+	cli, _ = b.OpenSession("tmp", true, 0)
+	b.SetSessionExpiry(cli, NeverExpire)
+	b.CloseSession(cli)
+	_, present = b.OpenSession("tmp", false, 0)
+	assert.True(t, present, "the interval was changed before the connection ended")
+}
+
+func matches(b *Broker, name string) []string {
+	subs := b.topics.Load().(*topic.Tree).Match(name)
+	defer topic.PutSubs(subs)
+
+	ids := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		ids = append(ids, sub.Subscriber.ID())
+	}
+	return ids
+}
+
+func TestInProcessSubscriber(t *testing.T) {
+	b := New()
+
+	sub := &recordingSub{id: "app"}
+	b.Subscribe("sensors/#", sub, 1)
+
+	b.Publish(topic.Message{Topic: "sensors/temp", Payload: []byte("21"), QoS: 2})
+	require.Len(t, sub.msgs, 1)
+	assert.Equal(t, "sensors/temp", sub.msgs[0].Topic)
+	assert.Equal(t, []byte("21"), sub.msgs[0].Payload)
+	assert.Equal(t, byte(1), sub.msgs[0].QoS, "downgraded to the granted QoS")
+
+	assert.True(t, b.Unsubscribe("sensors/#", "app"))
+	b.Publish(topic.Message{Topic: "sensors/temp", Payload: []byte("22")})
+	assert.Len(t, sub.msgs, 1)
+}
+
+func TestSharedFrame(t *testing.T) {
+	b := New()
+
+	a := &recordingSub{id: "a"}
+	c := &recordingSub{id: "c"}
+	b.Subscribe("t", a, 0)
+	b.Subscribe("t", c, 0)
+	b.Publish(topic.Message{Topic: "t", Payload: []byte("x"), Retain: true})
+
+	fa, err := a.msgs[0].Frame(protocol.Version311)
+	require.NoError(t, err)
+	fc, err := c.msgs[0].Frame(protocol.Version311)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 't', 'x'}, fa)
+	assert.Same(t, &fa[0], &fc[0], "the frame is encoded once")
+
+	fa, err = a.msgs[0].Frame(protocol.Version5)
+	require.NoError(t, err)
+	fc, err = c.msgs[0].Frame(protocol.Version5)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x30, 0x05, 0x00, 0x01, 't', 0x00, 'x'}, fa)
+	assert.Same(t, &fa[0], &fc[0], "the frame is encoded once per version")
+}
+
+// queuedSub is a recordingSub reporting a fixed queue length.
+type queuedSub struct {
+	recordingSub
+	queued int
+}
+
+func (q *queuedSub) QueueLen() int {
+	return q.queued
+}
+
+func TestSharedSubscriptions(t *testing.T) {
+	publish := func(b *Broker, n int, from string) {
+		for range n {
+			b.Publish(topic.Message{Topic: "jobs/1", Payload: []byte("x"), QoS: 1, From: from})
+		}
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		b := New()
+		plain := &recordingSub{id: "plain"}
+		b.Subscribe("jobs/#", plain, 1)
+
+		members := []*recordingSub{{id: "a"}, {id: "b"}, {id: "c"}}
+		for _, m := range members {
+			b.Subscribe("$share/workers/jobs/+", m, 0)
+		}
+
+		publish(b, 6, "")
+		assert.Len(t, plain.msgs, 6, "other subscribers get every message")
+		for _, m := range members {
+			require.Len(t, m.msgs, 2, m.id)
+			assert.Equal(t, byte(0), m.msgs[0].QoS, "downgraded to the member's QoS")
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		b := New(WithSharedStrategy(SharedRandom))
+		a := &recordingSub{id: "a"}
+		c := &recordingSub{id: "c"}
+		b.Subscribe("$share/g/jobs/1", a, 1)
+		b.Subscribe("$share/g/jobs/1", c, 1)
+
+		publish(b, 100, "")
+		assert.Equal(t, 100, len(a.msgs)+len(c.msgs), "each message goes to one member")
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		b := New(WithSharedStrategy(SharedSticky))
+		members := []*recordingSub{{id: "a"}, {id: "b"}, {id: "c"}}
+		for _, m := range members {
+			b.Subscribe("$share/g/jobs/+", m, 1)
+		}
+
+		publish(b, 5, "sensor-1")
+		var got int
+		for _, m := range members {
+			if len(m.msgs) > 0 {
+				got++
+				assert.Len(t, m.msgs, 5, "a publisher sticks to one member")
+			}
+		}
+		assert.Equal(t, 1, got)
+	})
+
+	t.Run("least queue", func(t *testing.T) {
+		b := New(WithSharedStrategy(SharedLeastQueue))
+		busy := &queuedSub{recordingSub: recordingSub{id: "busy"}, queued: 10}
+		idle := &queuedSub{recordingSub: recordingSub{id: "idle"}, queued: 2}
+		b.Subscribe("$share/g/jobs/+", busy, 1)
+		b.Subscribe("$share/g/jobs/+", idle, 1)
+
+		publish(b, 3, "")
+		assert.Empty(t, busy.msgs)
+		assert.Len(t, idle.msgs, 3)
+	})
+
+	t.Run("no retained messages on subscribe", func(t *testing.T) {
+		b := New()
+		b.Publish(topic.Message{Topic: "jobs/1", Payload: []byte("x"), Retain: true})
+
+		sub := &recordingSub{id: "a"}
+		b.Subscribe("$share/g/jobs/+", sub, 1)
+		assert.Empty(t, sub.msgs)
+
+		require.True(t, b.Unsubscribe("$share/g/jobs/+", "a"))
+		publish(b, 1, "")
+		assert.Empty(t, sub.msgs)
+	})
+}
+
+func TestMessageExpiry(t *testing.T) {
+	b := New()
+
+	t.Run("retained", func(t *testing.T) {
+		b.Publish(topic.Message{Topic: "state", Payload: []byte("x"), Retain: true, Expiry: time.Now().Add(30 * time.Millisecond)})
+
+		early := &recordingSub{id: "early"}
+		b.Subscribe("state", early, 0)
+		require.Len(t, early.msgs, 1)
+
+		time.Sleep(50 * time.Millisecond)
+
+		late := &recordingSub{id: "late"}
+		b.Subscribe("state", late, 0)
+		assert.Empty(t, late.msgs)
+		assert.Empty(t, b.retained.msgs, "expired messages are removed")
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		cli, _ := b.OpenSession("dev", false, NeverExpire)
+		b.Subscribe("cmd/#", cli, 1)
+
+		b.Publish(topic.Message{Topic: "cmd/stale", Payload: []byte("1"), QoS: 1, Expiry: time.Now().Add(30 * time.Millisecond)})
+		b.Publish(topic.Message{Topic: "cmd/fresh", Payload: []byte("2"), QoS: 1, Expiry: time.Now().Add(10 * time.Second)})
+		b.Publish(topic.Message{Topic: "cmd/forever", Payload: []byte("3"), QoS: 1})
+
+		time.Sleep(50 * time.Millisecond)
+
+		srv, conn := net.Pipe()
+		defer conn.Close()
+		go cli.Attach(srv, client.ConnParams{Version: protocol.Version5})
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		pkt, err := protocol.DecodeVersion(conn, protocol.Version5)
+		require.NoError(t, err)
+		pub := pkt.(*protocol.PublishPacket)
+		assert.Equal(t, "cmd/fresh", pub.Topic, "expired messages are not sent")
+		require.NotNil(t, pub.Properties)
+		assert.Equal(t, uint32(10), *pub.Properties.MessageExpiry, "the interval is the time left")
+
+		pkt, err = protocol.DecodeVersion(conn, protocol.Version5)
+		require.NoError(t, err)
+		pub = pkt.(*protocol.PublishPacket)
+		assert.Equal(t, "cmd/forever", pub.Topic)
+		assert.Nil(t, pub.Properties)
+	})
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	b := New()
+
+	t.Run("no local", func(t *testing.T) {
+		self := &recordingSub{id: "bridge"}
+		b.SubscribeWith("sync/#", topic.Subscription{Subscriber: self, QoS: 1, NoLocal: true})
+
+		b.Publish(topic.Message{Topic: "sync/a", Payload: []byte("own"), From: "bridge"})
+		b.Publish(topic.Message{Topic: "sync/a", Payload: []byte("other"), From: "dev"})
+
+		require.Len(t, self.msgs, 1)
+		assert.Equal(t, "other", string(self.msgs[0].Payload))
+	})
+
+	t.Run("retain as published", func(t *testing.T) {
+		plain := &recordingSub{id: "plain"}
+		rap := &recordingSub{id: "rap"}
+		b.Subscribe("rap/#", plain, 0)
+		b.SubscribeWith("rap/#", topic.Subscription{Subscriber: rap, RetainAsPublished: true})
+
+		b.Publish(topic.Message{Topic: "rap/x", Payload: []byte("1"), Retain: true})
+
+		require.Len(t, plain.msgs, 1)
+		require.Len(t, rap.msgs, 1)
+		assert.False(t, plain.msgs[0].Retain)
+		assert.True(t, rap.msgs[0].Retain)
+
+		fp, err := plain.msgs[0].Frame(protocol.Version311)
+		require.NoError(t, err)
+		fr, err := rap.msgs[0].Frame(protocol.Version311)
+		require.NoError(t, err)
+		assert.Equal(t, byte(0x30), fp[0])
+		assert.Equal(t, byte(0x31), fr[0], "the frame keeps the RETAIN flag")
+	})
+
+	t.Run("retain handling", func(t *testing.T) {
+		b.Publish(topic.Message{Topic: "state", Payload: []byte("on"), Retain: true})
+
+		always := &recordingSub{id: "always"}
+		b.SubscribeWith("state", topic.Subscription{Subscriber: always})
+		b.SubscribeWith("state", topic.Subscription{Subscriber: always})
+		assert.Len(t, always.msgs, 2, "sent on every subscribe")
+
+		onNew := &recordingSub{id: "new"}
+		b.SubscribeWith("state", topic.Subscription{Subscriber: onNew, RetainHandling: 1})
+		b.SubscribeWith("state", topic.Subscription{Subscriber: onNew, RetainHandling: 1})
+		assert.Len(t, onNew.msgs, 1, "only sent for a new subscription")
+
+		never := &recordingSub{id: "never"}
+		b.SubscribeWith("state", topic.Subscription{Subscriber: never, RetainHandling: 2})
+		assert.Empty(t, never.msgs)
+	})
+}
+
+func TestSubscriptionIdentifiers(t *testing.T) {
+	b := New()
+
+	b.Publish(topic.Message{Topic: "home/kitchen/temp", Payload: []byte("20"), Retain: true})
+
+	sub := &recordingSub{id: "app"}
+	b.SubscribeWith("home/#", topic.Subscription{Subscriber: sub, QoS: 0, Identifier: 2})
+	require.Len(t, sub.msgs, 1)
+	assert.Equal(t, []uint32{2}, sub.msgs[0].SubscriptionIdentifiers, "retained messages carry the identifier")
+
+	b.SubscribeWith("home/+/temp", topic.Subscription{Subscriber: sub, QoS: 1, Identifier: 1})
+	b.Subscribe("home/kitchen/#", sub, 0)
+	sub.msgs = nil
+
+	b.Publish(topic.Message{Topic: "home/kitchen/temp", Payload: []byte("21"), QoS: 1})
+	require.Len(t, sub.msgs, 2, "one copy for the identified subscriptions, one for the other")
+
+	var identified topic.Message
+	for _, msg := range sub.msgs {
+		if msg.SubscriptionIdentifiers != nil {
+			identified = msg
+		}
+	}
+	assert.Equal(t, []uint32{1, 2}, identified.SubscriptionIdentifiers)
+	assert.Equal(t, byte(1), identified.QoS, "the highest granted QoS")
+
+	frame, err := (&topic.Message{Topic: "t", SubscriptionIdentifiers: []uint32{5}}).Frame(protocol.Version5)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x30, 0x06, 0x00, 0x01, 't', 0x02, 0x0B, 0x05}, frame)
+}
+
+// fullSub refuses every message, like a client whose queue is full.
+type fullSub struct{}
+
+func (fullSub) ID() string {
+	return "full"
+}
+
+func (fullSub) Deliver(topic.Message) error {
+	return errors.New("queue is full")
+}
+
+func TestDeliveryFailure(t *testing.T) {
+	b := New()
+
+	sub := &recordingSub{id: "a"}
+	b.Subscribe("#", fullSub{}, 1)
+	b.Subscribe("#", sub, 1)
+	b.SubscribeWith("jobs", topic.Subscription{Subscriber: fullSub{}, QoS: 1, Identifier: 1})
+
+	b.Publish(topic.Message{Topic: "jobs", Payload: []byte("1"), QoS: 1, Retain: true})
+	assert.Len(t, sub.msgs, 1, "a subscriber refusing the message does not hold up the others")
+
+	b.Subscribe("jobs", fullSub{}, 1)
+	b.Subscribe("jobs", sub, 1)
+	assert.Len(t, sub.msgs, 2)
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// retainedStore keeps the last retained message published to each topic.
+type retainedStore struct {
+	mu   sync.RWMutex
+	msgs map[string]topic.Message
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{
+		msgs: make(map[string]topic.Message),
+	}
+}
+
+// set stores msg as the retained message of its topic, replacing the
+// previous one. A message with an empty payload removes the retained
+// message of the topic instead.
+func (r *retainedStore) set(msg topic.Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(msg.Payload) == 0 {
+		delete(r.msgs, msg.Topic)
+		return
+	}
+
+	msg.Retain = true
+	// The frame of an expiring message carries the time it has left, so it
+	// is encoded again for every subscriber.
+	if msg.Expiry.IsZero() {
+		msg.ShareFrame()
+	}
+	r.msgs[msg.Topic] = msg
+}
+
+// match returns the retained messages whose topic matches the given filter.
+// Expired messages are left out and removed from the store.
+func (r *retainedStore) match(filter string) []topic.Message {
+	r.mu.RLock()
+
+	var out []topic.Message
+	var expired []string
+	for name, msg := range r.msgs {
+		if !topic.MatchFilter(filter, name) {
+			continue
+		}
+		if msg.Expired() {
+			expired = append(expired, name)
+			continue
+		}
+		out = append(out, msg)
+	}
+
+	r.mu.RUnlock()
+
+	if len(expired) > 0 {
+		r.removeExpired(expired)
+	}
+
+	return out
+}
+
+// removeExpired removes the retained messages of the given topics if they
+// are still expired, since another one may have been retained meanwhile.
+func (r *retainedStore) removeExpired(topics []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, name := range topics {
+		if msg, ok := r.msgs[name]; ok && msg.Expired() {
+			delete(r.msgs, name)
+		}
+	}
+}
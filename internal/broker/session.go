@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"math"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/client"
+)
+
+// NeverExpire is the session expiry interval of a session kept until the
+// client starts a clean one: an MQTT 3.1.1 persistent session, or an
+// MQTT 5 session with the maximum interval.
+const NeverExpire = math.MaxUint32
+
+// session is the state the broker keeps for a client identifier. The
+// client holds the in-flight and queued messages, and the subscriptions
+// live in the topic tree under the same identifier, so both survive the
+// network connection for as long as the session expiry interval.
+type session struct {
+	client *client.Client
+
+	// expiry is the session expiry interval in seconds: 0 ends the session
+	// with its connection, and NeverExpire keeps it forever.
+	expiry uint32
+
+	// timer ends the session once it has been disconnected for its expiry
+	// interval. It is nil while the session is connected. timerGen tells a
+	// timer that fired apart from the current one.
+	timer    *time.Timer
+	timerGen uint64
+}
+
+// OpenSession returns the client to use for a connection with the given
+// client identifier, and whether an existing session was resumed. expiry
+// is the session expiry interval of the connection, in seconds.
+//
+// Unless clean is set, a session that outlives its connections (with a
+// non-zero expiry interval) is resumed if one exists, keeping its
+// subscriptions and queued messages. Otherwise any previous session is
+// discarded together with its subscriptions and a new one is started.
+func (b *Broker) OpenSession(clientID string, clean bool, expiry uint32) (*client.Client, bool) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+
+	if prev, ok := b.sessions[clientID]; ok {
+		prev.stopTimer()
+
+		if !clean && prev.expiry != 0 {
+			prev.expiry = expiry
+			return prev.client, true
+		}
+
+		b.UnsubscribeAll(clientID)
+		prev.client.Close()
+	}
+
+	cli := client.New(clientID)
+	b.sessions[clientID] = &session{
+		client: cli,
+		expiry: expiry,
+	}
+
+	return cli, false
+}
+
+// SetSessionExpiry changes the session expiry interval of the session of
+// cli, for an MQTT 5 client sending a new one in its DISCONNECT. It takes
+// effect when the connection ends.
+func (b *Broker) SetSessionExpiry(cli *client.Client, expiry uint32) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+
+	if sess, ok := b.sessions[cli.ID()]; ok && sess.client == cli {
+		sess.expiry = expiry
+	}
+}
+
+// CloseSession is called when the connection of a client ends. A session
+// with an expiry interval of 0 is discarded together with its
+// subscriptions right away. Others are kept so the client can resume them
+// and messages published in the meantime are queued, until their expiry
+// interval elapses without a new connection.
+//
+// Clients whose session has already been replaced by a newer connection
+// are ignored.
+func (b *Broker) CloseSession(cli *client.Client) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+
+	sess, ok := b.sessions[cli.ID()]
+	if !ok || sess.client != cli {
+		return
+	}
+
+	switch sess.expiry {
+	case 0:
+		b.endSession(sess)
+	case NeverExpire:
+	default:
+		sess.stopTimer()
+		gen := sess.timerGen
+		sess.timer = time.AfterFunc(time.Duration(sess.expiry)*time.Second, func() {
+			b.expireSession(sess, gen)
+		})
+	}
+}
+
+// expireSession ends sess when its expiry timer of generation gen fires,
+// unless the session was resumed or replaced in the meantime.
+func (b *Broker) expireSession(sess *session, gen uint64) {
+	b.sessionsMu.Lock()
+	defer b.sessionsMu.Unlock()
+
+	if b.sessions[sess.client.ID()] != sess || sess.timerGen != gen {
+		return
+	}
+
+	b.endSession(sess)
+	sess.client.Close()
+}
+
+// endSession removes sess and its subscriptions. Its queued messages go
+// away with its client. The caller must hold b.sessionsMu.
+func (b *Broker) endSession(sess *session) {
+	delete(b.sessions, sess.client.ID())
+	b.UnsubscribeAll(sess.client.ID())
+}
+
+// stopTimer stops the expiry timer of a disconnected session, including
+// one that already fired but did not end the session yet.
+func (s *session) stopTimer() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.timerGen++
+}
@@ -0,0 +1,83 @@
+package broker
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// SharedStrategy selects the member of a shared subscription group that
+// receives a message.
+type SharedStrategy int
+
+const (
+	// SharedRoundRobin hands messages to the members of a group in turn.
+	SharedRoundRobin SharedStrategy = iota
+
+	// SharedRandom picks a member at random for every message.
+	SharedRandom
+
+	// SharedSticky sends all the messages of a publishing client to the same
+	// member, for as long as the group does not change, keeping them in
+	// order. Messages published in-process share a member as well.
+	SharedSticky
+
+	// SharedLeastQueue picks the member with the fewest messages waiting,
+	// as reported by a QueueLen method. Members without one count as
+	// having an empty queue.
+	SharedLeastQueue
+)
+
+// Option configures a Broker.
+type Option func(*Broker)
+
+// WithSharedStrategy sets how shared subscriptions pick the member that
+// receives a message. The default is SharedRoundRobin.
+func WithSharedStrategy(strategy SharedStrategy) Option {
+	return func(b *Broker) {
+		b.sharedStrategy = strategy
+	}
+}
+
+// queueLener is implemented by subscribers that can report how many
+// messages are waiting for them, like client.Client.
+type queueLener interface {
+	QueueLen() int
+}
+
+// stickySeed makes the hashes of SharedSticky differ between processes.
+var stickySeed = maphash.MakeSeed()
+
+// pick returns the member of g that receives msg.
+func (b *Broker) pick(g *topic.SharedGroup, msg *topic.Message) topic.Subscription {
+	n := uint64(len(g.Members))
+
+	switch b.sharedStrategy {
+	case SharedRandom:
+		return g.Members[rand.Uint64N(n)]
+
+	case SharedSticky:
+		return g.Members[maphash.String(stickySeed, msg.From)%n]
+
+	case SharedLeastQueue:
+		// Start the scan at the next member in turn, so that ties are
+		// broken round-robin.
+		start := g.Next()
+		best, bestLen := -1, 0
+		for i := range n {
+			idx := int((start + i) % n)
+			qlen := 0
+			if q, ok := g.Members[idx].Subscriber.(queueLener); ok {
+				qlen = q.QueueLen()
+			}
+			if best < 0 || qlen < bestLen {
+				best, bestLen = idx, qlen
+			}
+		}
+		return g.Members[best]
+
+	default:
+		return g.Members[g.Next()%n]
+	}
+}
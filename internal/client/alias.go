@@ -0,0 +1,65 @@
+package client
+
+import (
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+)
+
+// topicAliases assigns topic aliases to the topics of the messages sent to
+// an MQTT 5 client, up to the maximum the client accepts. Aliases belong to
+// a network connection, so the table starts over on every Attach.
+//
+// Topics are given an alias the first time they are sent, while aliases
+// are left. Later messages on the same topic carry the alias and an empty
+// topic name. Once every alias is taken, other topics are sent in full.
+type topicAliases struct {
+	max     uint16
+	byTopic map[string]uint16
+}
+
+// reset empties the table and sets the number of aliases the client
+// accepts. Zero disables aliases.
+func (a *topicAliases) reset(max uint16) {
+	a.max = max
+	a.byTopic = nil
+}
+
+// apply returns pkt as it should be sent: unchanged, with a new alias for
+// its topic, or with the topic replaced by an existing alias. It reports
+// whether a new alias was assigned, which the caller must forget if the
+// packet cannot be sent.
+func (a *topicAliases) apply(pkt *protocol.PublishPacket) (*protocol.PublishPacket, bool) {
+	if a.max == 0 {
+		return pkt, false
+	}
+
+	alias, ok := a.byTopic[pkt.Topic]
+	if !ok && len(a.byTopic) >= int(a.max) {
+		return pkt, false
+	}
+
+	out := *pkt
+	if ok {
+		out.Topic = ""
+	} else {
+		if a.byTopic == nil {
+			a.byTopic = make(map[string]uint16)
+		}
+		alias = uint16(len(a.byTopic) + 1)
+		a.byTopic[pkt.Topic] = alias
+	}
+
+	var props protocol.Properties
+	if pkt.Properties != nil {
+		props = *pkt.Properties
+	}
+	props.TopicAlias = &alias
+	out.Properties = &props
+
+	return &out, !ok
+}
+
+// forget removes the alias of topic, after the packet that was to announce
+// it could not be sent.
+func (a *topicAliases) forget(topic string) {
+	delete(a.byTopic, topic)
+}
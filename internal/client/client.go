@@ -1,46 +1,234 @@
 package client
 
 import (
+	"bytes"
+	"cmp"
 	"errors"
 	"log"
 	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
 )
 
 var ErrClientQueueFull = errors.New("client queue is full")
 
-type Client struct {
-	id   string
-	conn net.Conn
+// sendQueueSize is the number of frames the send queue of a connection
+// holds.
+const sendQueueSize = 1024
+
+// disconnectTimeout bounds the time Disconnect waits for its final packet
+// to be written.
+const disconnectTimeout = time.Second
+
+// ErrNoPacketID is returned when every packet identifier is already taken
+// by an unacknowledged message.
+var ErrNoPacketID = errors.New("no packet identifier available")
+
+// ErrReceiveMaximumExceeded is returned by StoreInbound when the client
+// publishes a QoS 2 message while it already has as many unreleased ones as
+// the server allows.
+var ErrReceiveMaximumExceeded = errors.New("receive maximum exceeded")
+
+// errTooLarge is returned by send for a message larger than the maximum
+// packet size of the client.
+var errTooLarge = errors.New("packet exceeds the maximum packet size of the client")
+
+// ConnParams describes how to talk to a client over its network connection,
+// as negotiated in its CONNECT.
+type ConnParams struct {
+	// Version is the protocol version of the connection.
+	Version byte
 
-	sendQ chan []byte
-	done  chan struct{}
+	// TopicAliasMaximum is the number of topic aliases the client accepts
+	// from the server. Zero disables them, as does MQTT 3.1.1.
+	TopicAliasMaximum uint16
+
+	// ReceiveMaximum is the number of QoS 1 and QoS 2 messages the client
+	// accepts to have unacknowledged at once. Zero means 65535, the default
+	// of MQTT 5, which leaves MQTT 3.1.1 clients unlimited.
+	ReceiveMaximum uint16
+
+	// MaximumPacketSize is the size of the largest packet the client
+	// accepts, in bytes. Messages over it are not sent to the client. Zero
+	// means no limit.
+	MaximumPacketSize uint32
 }
 
-func New(id string, conn net.Conn) *Client {
-	c := &Client{
-		id:    id,
-		conn:  conn,
-		sendQ: make(chan []byte, 1024),
-		done:  make(chan struct{}),
-	}
+type Client struct {
+	id string
+
+	// sendQ is the send queue of the current connection, nil while there is
+	// none. Every connection gets its own, so the write loop of a replaced
+	// connection cannot take frames meant for the next one. It is read
+	// without mu by Enqueue.
+	sendQ atomic.Pointer[chan []byte]
+
+	// version is the protocol version of the current connection, which
+	// packets are encoded for.
+	version atomic.Uint32
 
-	go c.writeLoop()
+	// aliasing is set while the connection uses topic aliases, in which case
+	// QoS 0 messages are encoded for this client under mu instead of using
+	// the shared frame.
+	aliasing atomic.Bool
 
-	return c
+	// maxPacketSize is the MaximumPacketSize of the connection, read
+	// without mu when QoS 0 frames are delivered.
+	maxPacketSize atomic.Uint32
+
+	mu       sync.Mutex
+	conn     net.Conn
+	done     chan struct{}
+	stopped  chan struct{}
+	nextID   uint16
+	seq      uint64
+	inflight map[uint16]*message
+	aliases  topicAliases
+
+	// receiveMax is the ReceiveMaximum of the connection. unacked counts
+	// the in-flight messages sent on it and not acknowledged yet, and
+	// pending holds, in order, those waiting to be sent: for unacked to
+	// drop below receiveMax, or for room in the send queue.
+	receiveMax int
+	unacked    int
+	pending    []*message
+
+	// stalled is set when the send queue was too full for a pending
+	// message, so the write loop sends the pending messages once it has
+	// made room.
+	stalled atomic.Bool
+
+	// received holds the packet identifiers of QoS 2 messages from the
+	// client that were delivered but not released yet, so a retransmitted
+	// PUBLISH is not delivered twice.
+	received map[uint16]struct{}
+}
+
+// message is an outgoing QoS 1 or QoS 2 PUBLISH waiting to be acknowledged.
+//
+// seq records the order in which messages were published so they can be
+// retransmitted in that order, and sent reports whether the packet was
+// ever handed to a connection. released is set once a QoS 2 message has
+// been received by the client (PUBREC), from then on only the PUBREL is
+// retransmitted. counted is set while the message counts towards the
+// Receive Maximum of the current connection.
+//
+// expiry is when the message expires, from the Message Expiry Interval of
+// the packet, or the zero time if it does not. A message that expires
+// before it was ever sent is dropped.
+type message struct {
+	pkt      *protocol.PublishPacket
+	seq      uint64
+	expiry   time.Time
+	sent     bool
+	released bool
+	counted  bool
+}
+
+// New returns a client with the given identifier. It has no connection
+// until Attach is called; messages published to it in the meantime are
+// queued if their QoS is above 0.
+func New(id string) *Client {
+	return &Client{
+		id:       id,
+		inflight: make(map[uint16]*message),
+		received: make(map[uint16]struct{}),
+	}
 }
 
 func (c *Client) ID() string {
 	return c.id
 }
 
+// Version returns the protocol version of the current or last connection.
+func (c *Client) Version() byte {
+	return byte(c.version.Load())
+}
+
+// QueueLen returns the number of messages waiting for the client: the
+// frames in its send queue and the QoS 1 and QoS 2 messages not
+// acknowledged yet, which pile up while a persistent session is offline.
+func (c *Client) QueueLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.inflight)
+	if q := c.sendQ.Load(); q != nil {
+		n += len(*q)
+	}
+	return n
+}
+
+// Attach binds the client to a network connection with the given
+// parameters and starts writing its send queue to it. Any previous
+// connection is closed first.
+//
+// Messages still waiting for an acknowledgement are sent again on the new
+// connection, in their original order and with the DUP flag set on those
+// that had already been sent. Released QoS 2 messages get their PUBREL
+// sent again instead. Only as many messages as the client's Receive
+// Maximum are sent at first, the others follow as acknowledgements come
+// in. Frames left in the send queue of the old connection are discarded,
+// since they belong to QoS 0 deliveries or to messages that are
+// retransmitted anyway.
+func (c *Client) Attach(conn net.Conn, params ConnParams) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+
+	if params.Version != protocol.Version5 {
+		params.TopicAliasMaximum = 0
+		params.ReceiveMaximum = 0
+		params.MaximumPacketSize = 0
+	}
+	c.aliases.reset(params.TopicAliasMaximum)
+	c.aliasing.Store(params.TopicAliasMaximum > 0)
+	c.maxPacketSize.Store(params.MaximumPacketSize)
+
+	c.receiveMax = int(params.ReceiveMaximum)
+	if c.receiveMax == 0 {
+		c.receiveMax = 65535
+	}
+
+	c.conn = conn
+	c.done = make(chan struct{})
+	c.stopped = make(chan struct{})
+	c.version.Store(uint32(params.Version))
+
+	sendQ := make(chan []byte, sendQueueSize)
+	c.sendQ.Store(&sendQ)
+	go c.writeLoop(conn, sendQ, c.done, c.stopped)
+
+	c.retransmit()
+}
+
 // Enqueue adds a message to the client's send queue, which is
 // written to the underlying connection by the writeLoop goroutine.
 // If the send queue is full, the function returns ErrClientQueueFull.
 // This is intended to provide backpressure to the caller if the
 // client is unable to process messages quickly enough.
+//
+// Frames enqueued while the client has no connection are dropped, as they
+// are QoS 0 messages or control packets meant for a previous connection.
 func (c *Client) Enqueue(data []byte) error {
+	sendQ := c.sendQ.Load()
+	if sendQ == nil {
+		return nil
+	}
+
+	return enqueue(*sendQ, data)
+}
+
+// enqueue adds a frame to a send queue without blocking.
+func enqueue(sendQ chan []byte, data []byte) error {
 	select {
-	case c.sendQ <- data:
+	case sendQ <- data:
 		return nil
 	default:
 		// queue is full - backpressure
@@ -48,34 +236,492 @@ func (c *Client) Enqueue(data []byte) error {
 	}
 }
 
+// Deliver implements topic.Subscriber. QoS 0 messages are sent as their
+// shared frame, unless the connection uses topic aliases, while QoS 1 and
+// QoS 2 messages are encoded for this client, with a packet identifier of
+// its own, through EnqueuePublish. Expired messages are dropped, and so
+// are messages larger than the client's maximum packet size.
+func (c *Client) Deliver(msg topic.Message) error {
+	if msg.Expired() {
+		return nil
+	}
+
+	if msg.QoS == 0 && c.aliasing.Load() {
+		return c.deliverAliased(msg.Packet())
+	}
+
+	if msg.QoS == 0 {
+		frame, err := msg.Frame(c.Version())
+		if err != nil {
+			return err
+		}
+		if c.tooLarge(len(frame)) {
+			return nil
+		}
+		return c.Enqueue(frame)
+	}
+
+	return c.enqueuePublish(msg.Packet(), msg.Expiry)
+}
+
+// deliverAliased encodes a QoS 0 PUBLISH with a topic alias and queues it.
+// Assigning the alias and queueing the frame happen under mu, so the frame
+// announcing an alias is always queued before the frames using it.
+func (c *Client) deliverAliased(pub *protocol.PublishPacket) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	pkt, assigned := c.aliases.apply(pub)
+
+	var buf bytes.Buffer
+	err := protocol.EncodeVersion(&buf, pkt, c.Version())
+	if err == nil && c.tooLarge(buf.Len()) {
+		// The message is skipped, so the alias was never announced.
+		if assigned {
+			c.aliases.forget(pub.Topic)
+		}
+		return nil
+	}
+	if err == nil {
+		err = c.Enqueue(buf.Bytes())
+	}
+	if err != nil && assigned {
+		c.aliases.forget(pub.Topic)
+	}
+
+	return err
+}
+
+// EnqueuePublish queues a QoS 1 or QoS 2 PUBLISH for the client. It assigns
+// the packet identifier and keeps the message in flight until it is
+// acknowledged through Ack (QoS 1) or Complete (QoS 2).
+//
+// If the client has no connection the message is kept for the next one,
+// unless it expires first. The same goes while the client has as many
+// unacknowledged messages as its Receive Maximum allows, or while its send
+// queue is full: the message waits for its turn, and is not lost. Its
+// Message Expiry Interval is counted from now, and lowered to the time
+// left whenever the message is sent.
+func (c *Client) EnqueuePublish(pub *protocol.PublishPacket) error {
+	return c.enqueuePublish(pub, topic.ExpiresAt(pub.Properties))
+}
+
+// enqueuePublish is EnqueuePublish for a message expiring at expiry, or
+// never if it is the zero time.
+func (c *Client) enqueuePublish(pub *protocol.PublishPacket, expiry time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.allocID()
+	if !ok {
+		return ErrNoPacketID
+	}
+
+	pkt := *pub
+	pkt.PacketID = id
+	pkt.Dup = false
+
+	msg := &message{
+		pkt:    &pkt,
+		seq:    c.seq,
+		expiry: expiry,
+	}
+	c.seq++
+	c.inflight[id] = msg
+
+	if c.conn != nil {
+		c.pending = append(c.pending, msg)
+		c.flush()
+	}
+
+	return nil
+}
+
+// Ack releases the QoS 1 message with the given packet identifier after the
+// client sent a PUBACK for it. It reports whether such a message was waiting
+// for an acknowledgement.
+func (c *Client) Ack(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg, ok := c.inflight[packetID]
+	if !ok || msg.pkt.QoS != 1 {
+		return false
+	}
+
+	c.settle(msg)
+	return true
+}
+
+// Release handles a PUBREC from the client for a QoS 2 message: the message
+// is marked as received and a PUBREL is queued in reply. It reports whether
+// such a message was waiting for a PUBREC.
+func (c *Client) Release(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg, ok := c.inflight[packetID]
+	if !ok || msg.pkt.QoS != 2 {
+		return false
+	}
+
+	msg.released = true
+	if c.conn == nil {
+		return true
+	}
+
+	// A PUBREL that does not fit in the send queue goes ahead of the
+	// pending messages, since the client is waiting for it.
+	err := c.send(msg)
+	if errors.Is(err, ErrClientQueueFull) {
+		c.pending = slices.Insert(c.pending, 0, msg)
+		c.stalled.Store(true)
+		return true
+	}
+	if err != nil {
+		log.Printf("client %s pubrel error: %v", c.id, err)
+	}
+
+	return true
+}
+
+// Complete releases the QoS 2 message with the given packet identifier after
+// the client sent a PUBCOMP for it. It reports whether such a message was
+// waiting for completion.
+func (c *Client) Complete(packetID uint16) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg, ok := c.inflight[packetID]
+	if !ok || !msg.released {
+		return false
+	}
+
+	c.settle(msg)
+	return true
+}
+
+// StoreInbound records the packet identifier of a QoS 2 PUBLISH received from
+// the client. It reports whether the identifier is new; when it is not, the
+// PUBLISH is a retransmission of a message that was already delivered.
+//
+// A new identifier is refused with ErrReceiveMaximumExceeded when max
+// identifiers are stored already. Zero means no limit.
+func (c *Client) StoreInbound(packetID uint16, max int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.received[packetID]; ok {
+		return false, nil
+	}
+
+	if max > 0 && len(c.received) >= max {
+		return false, ErrReceiveMaximumExceeded
+	}
+
+	c.received[packetID] = struct{}{}
+	return true, nil
+}
+
+// ReleaseInbound forgets the packet identifier of a QoS 2 PUBLISH after the
+// client sent its PUBREL, so the identifier can be used for a new message.
+func (c *Client) ReleaseInbound(packetID uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.received, packetID)
+}
+
+// Send encodes a control packet, such as an acknowledgement, and adds it to
+// the send queue so it is written in order with the client's messages.
+func (c *Client) Send(p protocol.Packet) error {
+	var buf bytes.Buffer
+	if err := protocol.EncodeVersion(&buf, p, c.Version()); err != nil {
+		return err
+	}
+
+	return c.Enqueue(buf.Bytes())
+}
+
+// Disconnect sends a final packet on conn, typically an MQTT 5 DISCONNECT
+// telling the client why the server closes the connection, and closes conn
+// once the packet has been written or after a timeout. Like Detach, it
+// leaves alone a connection that was attached after conn.
+func (c *Client) Disconnect(conn net.Conn, p protocol.Packet) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	stopped := c.stopped
+	sendQ := c.sendQ.Load()
+	version := c.Version()
+	c.mu.Unlock()
+
+	// The packet goes to the queue of conn, not of a connection attached
+	// in the meantime. A nil frame makes the write loop stop once
+	// everything queued before it has been written.
+	var buf bytes.Buffer
+	if protocol.EncodeVersion(&buf, p, version) == nil && enqueue(*sendQ, buf.Bytes()) == nil && enqueue(*sendQ, nil) == nil {
+		select {
+		case <-stopped:
+		case <-time.After(disconnectTimeout):
+		}
+	}
+
+	c.Detach(conn)
+}
+
 // Close closes the client's underlying connection and marks it as done.
 // It is safe to call Close from multiple goroutines.
+//
+// In-flight messages are kept, so the client can be attached to a new
+// connection later.
 func (c *Client) Close() {
-	select {
-	case <-c.done:
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+}
+
+// Detach closes conn if it is still the client's current connection.
+// It lets the owner of a connection shut it down without touching one
+// that was attached after it, for example by a client reconnecting with
+// the same identifier.
+func (c *Client) Detach(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn {
+		c.closeLocked()
+	}
+}
+
+// closeLocked closes the current connection, if any. The caller must hold c.mu.
+func (c *Client) closeLocked() {
+	if c.conn == nil {
 		return
-	default:
-		close(c.done)
-		_ = c.conn.Close()
+	}
+
+	close(c.done)
+	_ = c.conn.Close()
+	c.conn = nil
+	c.sendQ.Store(nil)
+}
+
+// retransmit makes every in-flight message pending on the current
+// connection, in the order it was published, and sends as many as the
+// connection allows. The caller must hold c.mu.
+func (c *Client) retransmit() {
+	c.stalled.Store(false)
+	c.unacked = 0
+	c.pending = make([]*message, 0, len(c.inflight))
+	for _, msg := range c.inflight {
+		msg.counted = false
+		msg.pkt.Dup = msg.sent && !msg.released
+		c.pending = append(c.pending, msg)
+	}
+
+	slices.SortFunc(c.pending, func(a, b *message) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	c.flush()
+}
+
+// settle removes an acknowledged message from the in-flight messages, and
+// sends the pending ones its acknowledgement makes room for. The caller
+// must hold c.mu.
+func (c *Client) settle(msg *message) {
+	delete(c.inflight, msg.pkt.PacketID)
+	if msg.counted {
+		msg.counted = false
+		c.unacked--
+	}
+
+	if c.conn != nil {
+		c.flush()
+	}
+}
+
+// resume sends the pending messages of conn after its write loop made room
+// in a send queue that was full.
+func (c *Client) resume(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn && c.stalled.CompareAndSwap(true, false) {
+		c.flush()
+	}
+}
+
+// flush sends the pending messages in order, for as long as the Receive
+// Maximum of the connection and the room in the send queue allow. Messages
+// counted already, whose PUBREL is pending, do not wait for the Receive
+// Maximum. The caller must hold c.mu.
+func (c *Client) flush() {
+	for len(c.pending) > 0 {
+		next := c.pending[0]
+
+		// The message may have been acknowledged in the meantime, by a
+		// client guessing its packet identifier.
+		if c.inflight[next.pkt.PacketID] != next {
+			c.pending = c.pending[1:]
+			continue
+		}
+		if !next.counted && c.unacked >= c.receiveMax {
+			return
+		}
+
+		err := c.dispatch(next)
+		if errors.Is(err, ErrClientQueueFull) {
+			c.stalled.Store(true)
+			return
+		}
+		if err != nil {
+			// The message is left in flight for the next connection.
+			log.Printf("client %s send error: %v", c.id, err)
+		}
+		c.pending = c.pending[1:]
 	}
 }
 
-// writeLoop is a goroutine that writes data from the client's sendQ channel
-// to the underlying connection. It will block until the write is complete, and
-// will return if an error is encountered during the write. If the client's
-// done channel is closed, writeLoop will return.
-func (c *Client) writeLoop() {
+// dispatch sends an in-flight message on the current connection and counts
+// it towards the Receive Maximum. A message that expired before it was
+// ever sent, or that is larger than the client's maximum packet size, is
+// dropped instead. The caller must hold c.mu.
+func (c *Client) dispatch(msg *message) error {
+	if !msg.sent && !msg.expiry.IsZero() && !time.Now().Before(msg.expiry) {
+		delete(c.inflight, msg.pkt.PacketID)
+		return nil
+	}
+
+	err := c.send(msg)
+	if errors.Is(err, errTooLarge) {
+		log.Printf("client %s: dropping message on %s over its maximum packet size", c.id, msg.pkt.Topic)
+		delete(c.inflight, msg.pkt.PacketID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !msg.counted {
+		msg.counted = true
+		c.unacked++
+	}
+	return nil
+}
+
+// send encodes an in-flight message, or its PUBREL once it has been
+// released, and adds it to the send queue. The message is given a topic
+// alias when the connection uses them, and the time it has left when it
+// expires. It returns errTooLarge, without queueing anything, for a packet
+// over the client's maximum packet size. The caller must hold c.mu.
+func (c *Client) send(msg *message) error {
+	var (
+		p        protocol.Packet
+		assigned bool
+	)
+	if msg.released {
+		p = &protocol.PubRelPacket{PacketID: msg.pkt.PacketID}
+	} else {
+		p, assigned = c.aliases.apply(withExpiry(msg.pkt, msg.expiry))
+	}
+
+	var buf bytes.Buffer
+	err := protocol.EncodeVersion(&buf, p, c.Version())
+	if err == nil && c.tooLarge(buf.Len()) {
+		err = errTooLarge
+	}
+	if err == nil {
+		err = c.Enqueue(buf.Bytes())
+	}
+	if err != nil {
+		if assigned {
+			c.aliases.forget(msg.pkt.Topic)
+		}
+		return err
+	}
+
+	msg.sent = true
+	return nil
+}
+
+// tooLarge reports whether a packet of the given size exceeds the maximum
+// packet size of the connection.
+func (c *Client) tooLarge(size int) bool {
+	max := c.maxPacketSize.Load()
+	return max > 0 && uint64(size) > uint64(max)
+}
+
+// allocID returns the next packet identifier that is not in use by an
+// in-flight message. Packet identifiers are non-zero, so 0 is skipped when
+// the counter wraps around. The caller must hold c.mu.
+func (c *Client) allocID() (uint16, bool) {
+	for range 65535 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+
+		if _, used := c.inflight[c.nextID]; !used {
+			return c.nextID, true
+		}
+	}
+
+	return 0, false
+}
+
+// writeLoop is a goroutine that writes data from the send queue of a
+// connection to the connection. It will block until the write is complete, and
+// will return if an error is encountered during the write. If the done
+// channel of the connection is closed, or a nil frame queued by Disconnect
+// is reached, writeLoop will return and close stopped.
+func (c *Client) writeLoop(conn net.Conn, sendQ chan []byte, done, stopped chan struct{}) {
+	defer close(stopped)
+
 	for {
 		select {
-		case data := <-c.sendQ:
-			if _, err := c.conn.Write(data); err != nil {
+		case data := <-sendQ:
+			if data == nil {
+				return
+			}
+			if _, err := conn.Write(data); err != nil {
 				log.Printf("client %s write error: %v", c.id, err)
-				c.Close()
+				c.Detach(conn)
 				return
 			}
+			if c.stalled.Load() {
+				c.resume(conn)
+			}
 
-		case <-c.done:
+		case <-done:
 			return
 		}
 	}
 }
+
+// withExpiry returns pkt with its Message Expiry Interval set to the time
+// left until expiry, or pkt itself if it does not expire.
+func withExpiry(pkt *protocol.PublishPacket, expiry time.Time) *protocol.PublishPacket {
+	interval := topic.ExpiryInterval(expiry)
+	if interval == nil {
+		return pkt
+	}
+
+	var props protocol.Properties
+	if pkt.Properties != nil {
+		props = *pkt.Properties
+	}
+	props.MessageExpiry = interval
+
+	out := *pkt
+	out.Properties = &props
+
+	return &out
+}
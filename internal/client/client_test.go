@@ -0,0 +1,193 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+)
+
+// peer is the network side of a connection attached to a Client.
+type peer struct {
+	net.Conn
+}
+
+// attach attaches c to a new in-memory connection and returns its other
+// end.
+func attach(t *testing.T, c *Client) *peer {
+	t.Helper()
+
+	srv, cli := net.Pipe()
+	t.Cleanup(func() { cli.Close() })
+	c.Attach(srv, ConnParams{Version: protocol.Version311})
+
+	return &peer{Conn: cli}
+}
+
+// read returns the next packet written to the connection.
+func (p *peer) read(t *testing.T) protocol.Packet {
+	t.Helper()
+
+	require.NoError(t, p.SetReadDeadline(time.Now().Add(time.Second)))
+	pkt, err := protocol.Decode(p)
+	require.NoError(t, err)
+	return pkt
+}
+
+// publish reads the next packet and checks that it is a PUBLISH.
+func (p *peer) publish(t *testing.T) *protocol.PublishPacket {
+	t.Helper()
+
+	pub, ok := p.read(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	return pub
+}
+
+func TestBacklogLargerThanQueue(t *testing.T) {
+	c := New("dev")
+	const n = 3000
+
+	for i := range n {
+		require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{
+			Topic:   "backlog",
+			Payload: []byte(fmt.Sprint(i)),
+			QoS:     1,
+		}))
+	}
+
+	conn := attach(t, c)
+	for i := range n {
+		pub := conn.publish(t)
+		require.Equal(t, fmt.Sprint(i), string(pub.Payload), "messages arrive in order")
+		require.True(t, c.Ack(pub.PacketID))
+	}
+
+	assert.Empty(t, c.inflight, "every message was delivered")
+}
+
+func TestEnqueueWhileQueueFull(t *testing.T) {
+	c := New("dev")
+	conn := attach(t, c)
+	const n = 3000
+
+	// Nothing is read yet, so the send queue fills up.
+	for i := range n {
+		require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{
+			Topic:   "live",
+			Payload: []byte(fmt.Sprint(i)),
+			QoS:     1,
+		}), "messages are kept when the queue is full")
+	}
+
+	for i := range n {
+		pub := conn.publish(t)
+		require.Equal(t, fmt.Sprint(i), string(pub.Payload))
+		require.True(t, c.Ack(pub.PacketID))
+	}
+}
+
+func TestInflightTracking(t *testing.T) {
+	c := New("dev")
+	conn := attach(t, c)
+
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "a", Payload: []byte("1"), QoS: 1}))
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "b", Payload: []byte("2"), QoS: 2}))
+
+	first, second := conn.publish(t), conn.publish(t)
+	assert.NotEqual(t, first.PacketID, second.PacketID, "each message has its own packet identifier")
+	assert.False(t, first.Dup)
+	assert.Len(t, c.inflight, 2, "both messages wait for an acknowledgement")
+
+	assert.False(t, c.Ack(second.PacketID), "QoS 2 messages are not acknowledged by PUBACK")
+	assert.False(t, c.Release(first.PacketID), "QoS 1 messages are not acknowledged by PUBREC")
+	assert.False(t, c.Ack(first.PacketID+second.PacketID), "unknown packet identifiers are ignored")
+
+	assert.True(t, c.Ack(first.PacketID))
+	assert.False(t, c.Ack(first.PacketID), "a message is acknowledged once")
+	assert.Len(t, c.inflight, 1)
+}
+
+func TestQoS2Handshake(t *testing.T) {
+	c := New("dev")
+	conn := attach(t, c)
+
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "a", Payload: []byte("1"), QoS: 2}))
+	pub := conn.publish(t)
+
+	assert.False(t, c.Complete(pub.PacketID), "PUBCOMP is only accepted after PUBREC")
+
+	require.True(t, c.Release(pub.PacketID))
+	assert.Equal(t, &protocol.PubRelPacket{PacketID: pub.PacketID}, conn.read(t), "PUBREC is answered with PUBREL")
+
+	assert.True(t, c.Complete(pub.PacketID))
+	assert.False(t, c.Complete(pub.PacketID), "a message is completed once")
+	assert.Empty(t, c.inflight)
+}
+
+func TestRetransmitOnReconnect(t *testing.T) {
+	c := New("dev")
+	conn := attach(t, c)
+
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "a", Payload: []byte("1"), QoS: 1}))
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "b", Payload: []byte("2"), QoS: 2}))
+	acked, released := conn.publish(t), conn.publish(t)
+	require.True(t, c.Release(released.PacketID))
+	conn.read(t)
+
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "c", Payload: []byte("3"), QoS: 1}))
+	unsent := conn.publish(t)
+	require.True(t, c.Ack(acked.PacketID))
+
+	c.Close()
+	require.NoError(t, c.EnqueuePublish(&protocol.PublishPacket{Topic: "d", Payload: []byte("4"), QoS: 1}))
+
+	conn = attach(t, c)
+	assert.Equal(t, &protocol.PubRelPacket{PacketID: released.PacketID}, conn.read(t),
+		"released messages only get their PUBREL again")
+
+	again := conn.publish(t)
+	assert.Equal(t, unsent.PacketID, again.PacketID, "messages keep their packet identifier")
+	assert.True(t, again.Dup, "messages sent before are marked as duplicates")
+
+	queued := conn.publish(t)
+	assert.Equal(t, "d", queued.Topic, "messages are sent in the order they were published")
+	assert.False(t, queued.Dup, "messages queued offline are not duplicates")
+}
+
+func TestInboundQoS2AcrossReconnect(t *testing.T) {
+	c := New("dev")
+	attach(t, c)
+
+	stored, err := c.StoreInbound(7, 0)
+	require.NoError(t, err)
+	assert.True(t, stored)
+
+	attach(t, c)
+	stored, err = c.StoreInbound(7, 0)
+	require.NoError(t, err)
+	assert.False(t, stored, "a retransmission on the new connection is not delivered again")
+
+	c.ReleaseInbound(7)
+	stored, err = c.StoreInbound(7, 0)
+	require.NoError(t, err)
+	assert.True(t, stored, "released identifiers can be used again")
+
+	_, err = c.StoreInbound(8, 1)
+	assert.ErrorIs(t, err, ErrReceiveMaximumExceeded)
+}
+
+func TestReattachKeepsFrames(t *testing.T) {
+	c := New("dev")
+
+	for range 200 {
+		conn := attach(t, c)
+		require.NoError(t, c.Send(&protocol.PubAckPacket{PacketID: 1}))
+		assert.Equal(t, &protocol.PubAckPacket{PacketID: 1}, conn.read(t),
+			"the write loop of the previous connection does not take the frame")
+	}
+}
@@ -0,0 +1,15 @@
+package protocol
+
+// AuthPacket is an AUTH packet, exchanged by MQTT 5 clients and servers
+// during extended authentication. It does not exist in MQTT 3.1.1.
+//
+// It contains a reason code and properties holding the authentication
+// method and data.
+type AuthPacket struct {
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+func (a *AuthPacket) Type() PacketType {
+	return PacketTypeAuth
+}
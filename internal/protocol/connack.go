@@ -1,18 +1,27 @@
 package protocol
 
-type ConnAckReturnCode byte
+// ConnAckReturnCode is the result of a CONNECT. MQTT 3.1.1 clients are
+// answered with the return codes below, MQTT 5 clients with a ReasonCode.
+type ConnAckReturnCode = ReasonCode
 
 const (
-	ConnAckAccepted ConnAckReturnCode = 0x00
+	ConnAckAccepted                    ConnAckReturnCode = 0x00
+	ConnAckUnacceptableProtocolVersion ConnAckReturnCode = 0x01
+	ConnAckIdentifierRejected          ConnAckReturnCode = 0x02
+	ConnAckServerUnavailable           ConnAckReturnCode = 0x03
+	ConnAckBadUsernameOrPassword       ConnAckReturnCode = 0x04
+	ConnAckNotAuthorized               ConnAckReturnCode = 0x05
 )
 
 // ConnAckPacket is a CONNACK packet sent from the server to the client
 // in response to a CONNECT packet from the client.
 //
-// It contains a session present flag and a return code.
+// It contains a session present flag and a return code. MQTT 5 adds
+// properties describing the limits and features of the server.
 type ConnAckPacket struct {
 	SessionPresent bool
 	ReturnCode     ConnAckReturnCode
+	Properties     *Properties
 }
 
 func (c *ConnAckPacket) Type() PacketType {
@@ -5,8 +5,12 @@ package protocol
 // whether it wants to clean its session, and how often it wants to send
 // PINGREQ packets to the server.
 //
-// The client may also send a username and password to authenticate with the
-// server.
+// The client may also register a will message, which the server publishes
+// on its behalf if the connection ends without a DISCONNECT, and send a
+// username and password to authenticate with the server.
+//
+// MQTT 5 clients send properties with the connection, and with the will
+// message.
 type ConnectPacket struct {
 	ProtocolName  string
 	ProtocolLevel byte
@@ -15,6 +19,16 @@ type ConnectPacket struct {
 
 	ClientID string
 
+	Properties *Properties
+
+	WillFlag    bool
+	WillTopic   string
+	WillMessage []byte
+	WillQoS     byte
+	WillRetain  bool
+
+	WillProperties *Properties
+
 	Username *string
 	Password *string
 }
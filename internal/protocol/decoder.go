@@ -1,12 +1,28 @@
 package protocol
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
+// ErrUnsupportedProtocolVersion is returned when a CONNECT announces a
+// protocol level other than MQTT 3.1.1 or MQTT 5. The server answers it
+// with a CONNACK refusing the protocol version.
+var ErrUnsupportedProtocolVersion = errors.New("unsupported protocol level")
+
+// ErrInvalidTopicName is returned when a PUBLISH topic name contains a
+// wildcard. It is a protocol error, which closes the connection.
+var ErrInvalidTopicName = errors.New("wildcard in topic name")
+
+// maxEagerBody is the largest packet body allocated at once, as soon as its
+// Remaining Length is known. Larger bodies are read in chunks, so a peer
+// announcing a large packet only gets memory for the bytes it sends.
+const maxEagerBody = 64 * 1024
+
 // Decode reads a packet from the given io.Reader and returns the corresponding
 // decoded Packet, or an error if the packet is invalid.
 //
@@ -18,28 +34,113 @@ import (
 //
 // If the flags or remaining length are invalid for the given packet
 // type, the function returns an error.
+//
+// Decode never reads past the end of the packet, so it can be called
+// repeatedly on the same stream. Connections should use a Reader instead,
+// which buffers the stream and reuses its memory across packets.
 func Decode(r io.Reader) (Packet, error) {
-	br := bufio.NewReader(r)
+	return DecodeLimit(r, 0)
+}
 
-	b1, err := br.ReadByte()
+// DecodeLimit works like Decode, but rejects packets larger than
+// maxPacketSize bytes, fixed header included, with ErrPacketTooLarge.
+// The size is checked as soon as the fixed header has been read, before
+// any buffer is allocated for the rest of the packet.
+//
+// A maxPacketSize of zero or less only applies the protocol limit.
+func DecodeLimit(r io.Reader, maxPacketSize int) (Packet, error) {
+	return decodeStream(r, maxPacketSize, Version311)
+}
+
+// DecodeVersion works like Decode, but decodes packets in the format of the
+// given protocol version, Version311 or Version5. A CONNECT is always
+// decoded for the protocol level it announces.
+func DecodeVersion(r io.Reader, version byte) (Packet, error) {
+	return decodeStream(r, 0, version)
+}
+
+func decodeStream(r io.Reader, maxPacketSize int, version byte) (Packet, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &singleByteReader{r: r}
+	}
+
+	header, remainingLength, err := readFixedHeader(br, maxPacketSize)
 	if err != nil {
 		return nil, err
 	}
 
-	packetType := PacketType(b1 >> 4)
-	flags := b1 & 0x0F
-
-	remainingLength, err := decodeRemainingLength(br)
+	body, err := readBody(r, remainingLength)
 	if err != nil {
 		return nil, err
 	}
 
+	// The body is private to this call, so decoded fields may point into it.
+	return decodePacket(header, &decoder{buf: body, version: version})
+}
+
+// readBody reads a packet body of n bytes. Bodies up to maxEagerBody are
+// read into a buffer of their size; larger ones into a buffer growing with
+// the bytes actually read.
+func readBody(r io.Reader, n int) ([]byte, error) {
+	if n <= maxEagerBody {
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readFixedHeader reads the first byte of a packet and its Remaining Length,
+// and checks the packet size against maxPacketSize when it is positive.
+func readFixedHeader(r io.ByteReader, maxPacketSize int) (byte, int, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	remainingLength, err := decodeRemainingLength(r)
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+
+	if maxPacketSize > 0 {
+		if 1+remainingLengthSize(remainingLength)+remainingLength > maxPacketSize {
+			return 0, 0, ErrPacketTooLarge
+		}
+	}
+
+	return header, remainingLength, nil
+}
+
+// decodePacket decodes the body of a packet whose fixed header starts with
+// the given byte.
+func decodePacket(header byte, d *decoder) (Packet, error) {
+	packetType := PacketType(header >> 4)
+	flags := header & 0x0F
+	remainingLength := d.remaining()
+	v5 := d.version == Version5
+
 	switch packetType {
 	case PacketTypeConnect:
 		if flags != 0 {
 			return nil, errors.New("invalid CONNECT flags")
 		}
-		return decodeConnect(br, remainingLength)
+		return decodeConnect(d)
+
+	case PacketTypeConnAck:
+		if flags != 0 || remainingLength < 2 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid CONNACK packet")
+		}
+		return decodeConnAck(d)
 
 	case PacketTypePingReq:
 		if flags != 0 || remainingLength != 0 {
@@ -47,42 +148,126 @@ func Decode(r io.Reader) (Packet, error) {
 		}
 		return &PingReqPacket{}, nil
 
+	case PacketTypePingResp:
+		if flags != 0 || remainingLength != 0 {
+			return nil, errors.New("invalid PINGRESP packet")
+		}
+		return &PingRespPacket{}, nil
+
 	case PacketTypeSubscribe:
 		if flags != 0x02 {
 			return nil, errors.New("invalid SUBSCRIBE flags")
 		}
-		return decodeSubscribe(br, remainingLength)
+		return decodeSubscribe(d)
+
+	case PacketTypeSubAck:
+		if flags != 0 {
+			return nil, errors.New("invalid SUBACK flags")
+		}
+		return decodeSubAck(d)
+
+	case PacketTypeUnsubscribe:
+		if flags != 0x02 {
+			return nil, errors.New("invalid UNSUBSCRIBE flags")
+		}
+		return decodeUnsubscribe(d)
+
+	case PacketTypeUnsubAck:
+		if flags != 0 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid UNSUBACK packet")
+		}
+		return decodeUnsubAck(d)
 
 	case PacketTypePublish:
 		qos := (flags >> 1) & 0x03
-		if qos != 0 {
-			return nil, errors.New("only QoS 0 supported")
+		if qos > 2 {
+			return nil, errors.New("invalid QoS level")
+		}
+		dup := flags&0x08 != 0
+		if dup && qos == 0 {
+			return nil, errors.New("DUP flag must be 0 for QoS 0 messages")
+		}
+		pub, err := decodePublish(d, qos, dup)
+		if err != nil {
+			return nil, err
+		}
+		pub.Retain = flags&0x01 != 0
+		return pub, nil
+
+	case PacketTypePubAck:
+		if flags != 0 || remainingLength < 2 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid PUBACK packet")
+		}
+		packetID, code, props, err := decodeAck(d, PacketTypePubAck)
+		if err != nil {
+			return nil, err
+		}
+		return &PubAckPacket{PacketID: packetID, ReasonCode: code, Properties: props}, nil
+
+	case PacketTypePubRec:
+		if flags != 0 || remainingLength < 2 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid PUBREC packet")
+		}
+		packetID, code, props, err := decodeAck(d, PacketTypePubRec)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRecPacket{PacketID: packetID, ReasonCode: code, Properties: props}, nil
+
+	case PacketTypePubRel:
+		if flags != 0x02 || remainingLength < 2 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid PUBREL packet")
+		}
+		packetID, code, props, err := decodeAck(d, PacketTypePubRel)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRelPacket{PacketID: packetID, ReasonCode: code, Properties: props}, nil
+
+	case PacketTypePubComp:
+		if flags != 0 || remainingLength < 2 || !v5 && remainingLength != 2 {
+			return nil, errors.New("invalid PUBCOMP packet")
+		}
+		packetID, code, props, err := decodeAck(d, PacketTypePubComp)
+		if err != nil {
+			return nil, err
 		}
-		return decodePublish(br, remainingLength)
+		return &PubCompPacket{PacketID: packetID, ReasonCode: code, Properties: props}, nil
 
 	case PacketTypeDisconnect:
-		if flags != 0 || remainingLength != 0 {
+		if flags != 0 || !v5 && remainingLength != 0 {
 			return nil, errors.New("invalid DISCONNECT packet")
 		}
-		return &DisconnectPacket{}, nil
+		code, props, err := decodeReason(d, PacketTypeDisconnect)
+		if err != nil {
+			return nil, err
+		}
+		return &DisconnectPacket{ReasonCode: code, Properties: props}, nil
+
+	case PacketTypeAuth:
+		if flags != 0 || !v5 {
+			return nil, errors.New("invalid AUTH packet")
+		}
+		code, props, err := decodeReason(d, PacketTypeAuth)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthPacket{ReasonCode: code, Properties: props}, nil
 
 	default:
 		return nil, errors.New("unsupported packet type")
 	}
 }
 
-// Decode a CONNECT packet from the given io.Reader and returns the decoded
-// ConnectPacket, or an error if the packet is invalid.
+// Decode a CONNECT packet body and returns the decoded ConnectPacket, or an
+// error if the packet is invalid.
 //
-// If the packet type is not supported, the function returns an error.
-func decodeConnect(r io.Reader, remainingLength int) (*ConnectPacket, error) {
-	lr := &io.LimitedReader{
-		R: r,
-		N: int64(remainingLength),
-	}
-
+// The rest of the packet is decoded for the protocol level it announces.
+// Levels other than MQTT 3.1.1 and MQTT 5 are rejected with
+// ErrUnsupportedProtocolVersion.
+func decodeConnect(d *decoder) (*ConnectPacket, error) {
 	// Protocol Name
-	protoName, err := readUTF8String(lr)
+	protoName, err := d.readString()
 	if err != nil {
 		return nil, err
 	}
@@ -91,98 +276,221 @@ func decodeConnect(r io.Reader, remainingLength int) (*ConnectPacket, error) {
 	}
 
 	// Protocol Level
-	var level [1]byte
-	if _, err := io.ReadFull(lr, level[:]); err != nil {
+	level, err := d.readByte()
+	if err != nil {
 		return nil, err
 	}
-	if level[0] != 0x04 {
-		return nil, errors.New("unsupported protocol level")
+	if level != Version311 && level != Version5 {
+		return nil, ErrUnsupportedProtocolVersion
 	}
+	v5 := level == Version5
 
 	// Connect Flags
-	var flags [1]byte
-	if _, err := io.ReadFull(lr, flags[:]); err != nil {
+	flags, err := d.readByte()
+	if err != nil {
 		return nil, err
 	}
 
-	if flags[0]&0x01 != 0 {
+	if flags&0x01 != 0 {
 		return nil, errors.New("reserved connect flag must be 0")
 	}
 
-	cleanSession := flags[0]&0x02 != 0
+	cleanSession := flags&0x02 != 0
+	willFlag := flags&0x04 != 0
+	willQoS := (flags >> 3) & 0x03
+	willRetain := flags&0x20 != 0
+	passwordFlag := flags&0x40 != 0
+	usernameFlag := flags&0x80 != 0
+
+	if willQoS > 2 {
+		return nil, errors.New("invalid will QoS")
+	}
+
+	if !willFlag && (willQoS != 0 || willRetain) {
+		return nil, errors.New("will QoS and retain must be 0 without a will")
+	}
+
+	// MQTT 5 allows a password without a username.
+	if passwordFlag && !usernameFlag && !v5 {
+		return nil, errors.New("password flag set without username flag")
+	}
 
 	// Keep Alive
-	var keepAlive uint16
-	if err := binary.Read(lr, binary.BigEndian, &keepAlive); err != nil {
+	keepAlive, err := d.readUint16()
+	if err != nil {
 		return nil, err
 	}
 
+	var props *Properties
+	if v5 {
+		if props, err = d.readProperties(PacketTypeConnect); err != nil {
+			return nil, err
+		}
+	}
+
 	// Payload
-	clientID, err := readUTF8String(lr)
+	clientID, err := d.readString()
 	if err != nil {
 		return nil, err
 	}
 
-	if clientID == "" && !cleanSession {
+	// MQTT 5 servers may assign an identifier whatever the Clean Start flag.
+	if clientID == "" && !cleanSession && !v5 {
 		return nil, errors.New("clientID must be present if clean session is false")
 	}
 
-	if lr.N != 0 {
-		return nil, errors.New("malformed CONNECT packet: extra bytes")
-	}
-
-	return &ConnectPacket{
+	pkt := &ConnectPacket{
 		ProtocolName:  protoName,
-		ProtocolLevel: level[0],
+		ProtocolLevel: level,
 		CleanSession:  cleanSession,
 		KeepAlive:     keepAlive,
 		ClientID:      clientID,
-	}, nil
+		Properties:    props,
+		WillFlag:      willFlag,
+		WillQoS:       willQoS,
+		WillRetain:    willRetain,
+	}
+
+	if willFlag {
+		if v5 {
+			if pkt.WillProperties, err = d.readProperties(willProperties); err != nil {
+				return nil, err
+			}
+		}
+
+		if pkt.WillTopic, err = d.readString(); err != nil {
+			return nil, err
+		}
+
+		if pkt.WillTopic == "" {
+			return nil, errors.New("empty will topic")
+		}
+
+		if pkt.WillMessage, err = d.readBinary(); err != nil {
+			return nil, err
+		}
+	}
+
+	if usernameFlag {
+		username, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		pkt.Username = &username
+	}
+
+	if passwordFlag {
+		password, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		pkt.Password = &password
+	}
+
+	if d.remaining() != 0 {
+		return nil, errors.New("malformed CONNECT packet: extra bytes")
+	}
+
+	return pkt, nil
+}
+
+// decodeConnAck decodes a CONNACK packet body.
+// Only the lowest bit of the acknowledge flags is defined, it carries the
+// session present flag; the others must be 0. MQTT 5 packets end with
+// properties.
+func decodeConnAck(d *decoder) (*ConnAckPacket, error) {
+	flags, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&^0x01 != 0 {
+		return nil, errors.New("reserved connack flags must be 0")
+	}
+
+	code, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if flags != 0 && code != byte(ConnAckAccepted) {
+		return nil, errors.New("session present set on a refused connection")
+	}
+
+	pkt := &ConnAckPacket{
+		SessionPresent: flags != 0,
+		ReturnCode:     ConnAckReturnCode(code),
+	}
+
+	if d.version == Version5 {
+		if pkt.Properties, err = d.readProperties(PacketTypeConnAck); err != nil {
+			return nil, err
+		}
+		if d.remaining() != 0 {
+			return nil, errors.New("malformed CONNACK packet: extra bytes")
+		}
+	}
+
+	return pkt, nil
 }
 
-// decodeSubscribe reads a SUBSCRIBE packet from the given io.Reader.
+// decodeSubscribe decodes a SUBSCRIBE packet body.
 // It returns a *SubscribePacket and an error if the packet is invalid.
-// The remainingLength parameter specifies the number of bytes remaining in the packet.
 // If the packet is malformed, an error will be returned.
 // If the packet is valid, a *SubscribePacket will be returned with its fields populated.
 // The *SubscribePacket will contain the packet identifier and a slice of Subscription objects,
-// each of which contains the topic name and QoS level.
-func decodeSubscribe(r io.Reader, remainingLength int) (*SubscribePacket, error) {
-	lr := &io.LimitedReader{
-		R: r,
-		N: int64(remainingLength),
-	}
-
-	var packetID uint16
-	if err := binary.Read(lr, binary.BigEndian, &packetID); err != nil {
+// each of which contains the topic name and QoS level. MQTT 5 packets also
+// carry properties and the other subscription options.
+func decodeSubscribe(d *decoder) (*SubscribePacket, error) {
+	packetID, err := d.readPacketID()
+	if err != nil {
 		return nil, err
 	}
 
-	if packetID == 0 {
-		return nil, errors.New("invalid packet identifier")
+	v5 := d.version == Version5
+
+	var props *Properties
+	if v5 {
+		if props, err = d.readProperties(PacketTypeSubscribe); err != nil {
+			return nil, err
+		}
+		if props != nil && len(props.SubscriptionIdentifiers) > 1 {
+			return nil, errors.New("more than one subscription identifier")
+		}
 	}
 
 	var subs []Subscription
 
-	for lr.N > 0 {
-		topic, err := readUTF8String(lr)
+	for d.remaining() > 0 {
+		topic, err := d.readString()
 		if err != nil {
 			return nil, err
 		}
 
-		var qos [1]byte
-		if _, err := io.ReadFull(lr, qos[:]); err != nil {
+		options, err := d.readByte()
+		if err != nil {
 			return nil, err
 		}
 
-		if qos[0] > 2 {
+		sub := Subscription{Topic: topic, QoS: options}
+		if v5 {
+			sub = Subscription{
+				Topic:             topic,
+				QoS:               options & 0x03,
+				NoLocal:           options&0x04 != 0,
+				RetainAsPublished: options&0x08 != 0,
+				RetainHandling:    (options >> 4) & 0x03,
+			}
+			if options&0xC0 != 0 || sub.RetainHandling > 2 {
+				return nil, errors.New("invalid subscription options")
+			}
+		}
+
+		if sub.QoS > 2 {
 			return nil, errors.New("invalid QoS level")
 		}
 
-		subs = append(subs, Subscription{
-			Topic: topic,
-			QoS:   qos[0],
-		})
+		subs = append(subs, sub)
 	}
 
 	if len(subs) == 0 {
@@ -192,57 +500,227 @@ func decodeSubscribe(r io.Reader, remainingLength int) (*SubscribePacket, error)
 	return &SubscribePacket{
 		PacketID:      packetID,
 		Subscriptions: subs,
+		Properties:    props,
 	}, nil
 }
 
-// decodePublish reads a PUBLISH packet from the given io.Reader.
+// decodeSubAck decodes a SUBACK packet body.
+// It returns a *SubAckPacket holding the packet identifier and one return
+// code per filter of the SUBSCRIBE: the granted QoS, or 0x80 for a failure.
+// MQTT 5 packets carry properties before the codes, and may report a
+// failure with any reason code from 0x80 up.
+func decodeSubAck(d *decoder) (*SubAckPacket, error) {
+	packetID, err := d.readPacketID()
+	if err != nil {
+		return nil, err
+	}
+
+	v5 := d.version == Version5
+
+	var props *Properties
+	if v5 {
+		if props, err = d.readProperties(PacketTypeSubAck); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.remaining() == 0 {
+		return nil, errors.New("suback must contain at least one return code")
+	}
+
+	codes := d.readRest()
+	for _, code := range codes {
+		if code > 2 && code != 0x80 && !(v5 && code > 0x80) {
+			return nil, errors.New("invalid SUBACK return code")
+		}
+	}
+
+	return &SubAckPacket{
+		PacketID:    packetID,
+		ReturnCodes: codes,
+		Properties:  props,
+	}, nil
+}
+
+// decodeUnsubscribe decodes an UNSUBSCRIBE packet body.
+// It returns an *UnsubscribePacket and an error if the packet is invalid.
+// The *UnsubscribePacket will contain the packet identifier and the list of
+// topic filters to remove, which must not be empty, and for MQTT 5 the
+// properties.
+func decodeUnsubscribe(d *decoder) (*UnsubscribePacket, error) {
+	packetID, err := d.readPacketID()
+	if err != nil {
+		return nil, err
+	}
+
+	var props *Properties
+	if d.version == Version5 {
+		if props, err = d.readProperties(PacketTypeUnsubscribe); err != nil {
+			return nil, err
+		}
+	}
+
+	var topics []string
+
+	for d.remaining() > 0 {
+		topic, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		topics = append(topics, topic)
+	}
+
+	if len(topics) == 0 {
+		return nil, errors.New("unsubscribe must contain at least one topic")
+	}
+
+	return &UnsubscribePacket{
+		PacketID:   packetID,
+		Topics:     topics,
+		Properties: props,
+	}, nil
+}
+
+// decodeUnsubAck decodes an UNSUBACK packet body: the packet identifier and,
+// for MQTT 5, properties and one reason code per topic filter.
+func decodeUnsubAck(d *decoder) (*UnsubAckPacket, error) {
+	packetID, err := d.readPacketID()
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := &UnsubAckPacket{PacketID: packetID}
+	if d.version != Version5 {
+		return pkt, nil
+	}
+
+	if pkt.Properties, err = d.readProperties(PacketTypeUnsubAck); err != nil {
+		return nil, err
+	}
+	if d.remaining() == 0 {
+		return nil, errors.New("unsuback must contain at least one reason code")
+	}
+	for _, code := range d.readRest() {
+		pkt.ReasonCodes = append(pkt.ReasonCodes, ReasonCode(code))
+	}
+
+	return pkt, nil
+}
+
+// decodeAck decodes the body of a PUBACK, PUBREC, PUBREL or PUBCOMP packet
+// of type t. MQTT 5 packets may follow the packet identifier with a reason
+// code and properties; a missing reason code means success.
+func decodeAck(d *decoder, t PacketType) (uint16, ReasonCode, *Properties, error) {
+	packetID, err := d.readPacketID()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	code, props, err := decodeReason(d, t)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return packetID, code, props, nil
+}
+
+// decodeReason decodes the optional reason code and properties that end
+// MQTT 5 acknowledgements and make up DISCONNECT and AUTH packets.
+func decodeReason(d *decoder, t PacketType) (ReasonCode, *Properties, error) {
+	if d.remaining() == 0 {
+		return ReasonSuccess, nil, nil
+	}
+
+	code, err := d.readByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if d.remaining() == 0 {
+		return ReasonCode(code), nil, nil
+	}
+
+	props, err := d.readProperties(t)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if d.remaining() != 0 {
+		return 0, nil, fmt.Errorf("malformed %s packet: extra bytes", packetName(t))
+	}
+
+	return ReasonCode(code), props, nil
+}
+
+// decodePublish decodes a PUBLISH packet body.
 // It returns a *PublishPacket and an error if the packet is invalid.
-// The remainingLength parameter specifies the number of bytes remaining in the packet.
 // If the packet is malformed, an error will be returned.
 // If the packet is valid, a *PublishPacket will be returned with its fields populated.
-// The *PublishPacket will contain the topic name and payload.
-func decodePublish(r io.Reader, remainingLength int) (*PublishPacket, error) {
-	lr := &io.LimitedReader{
-		R: r,
-		N: int64(remainingLength),
-	}
-
-	topic, err := readUTF8String(lr)
+// The *PublishPacket will contain the topic name and payload, and for QoS 1
+// and QoS 2 packets the packet identifier. MQTT 5 packets carry properties
+// before the payload.
+//
+// An MQTT 5 topic name may be empty when a topic alias stands for it.
+func decodePublish(d *decoder, qos byte, dup bool) (*PublishPacket, error) {
+	topic, err := d.readTopic()
 	if err != nil {
 		return nil, err
 	}
 
-	if topic == "" {
+	v5 := d.version == Version5
+	if topic == "" && !v5 {
 		return nil, errors.New("empty topic name")
 	}
+	if strings.ContainsAny(topic, "+#") {
+		return nil, ErrInvalidTopicName
+	}
 
-	// Remaining bytes = payload
-	payload := make([]byte, lr.N)
-	if _, err := io.ReadFull(lr, payload); err != nil {
-		return nil, err
+	var packetID uint16
+	if qos > 0 {
+		if packetID, err = d.readPacketID(); err != nil {
+			return nil, err
+		}
 	}
 
+	var props *Properties
+	if v5 {
+		if props, err = d.readProperties(PacketTypePublish); err != nil {
+			return nil, err
+		}
+		if topic == "" && (props == nil || props.TopicAlias == nil) {
+			return nil, errors.New("empty topic name")
+		}
+	}
+
+	// Remaining bytes = payload
+	payload := d.readRest()
+
 	return &PublishPacket{
-		Topic:   topic,
-		Payload: payload,
+		Topic:      topic,
+		Payload:    payload,
+		QoS:        qos,
+		Dup:        dup,
+		PacketID:   packetID,
+		Properties: props,
 	}, nil
 }
 
-// decodeRemainingLength reads a variable-length integer from the given io.Reader.
+// decodeRemainingLength reads a variable-length integer from the given io.ByteReader.
 // It returns the decoded integer and an error if the packet is invalid.
 // The function will return an error if the packet is malformed, or if
 // the end of the packet is reached before the integer is complete.
-func decodeRemainingLength(r io.Reader) (int, error) {
+func decodeRemainingLength(r io.ByteReader) (int, error) {
 	multiplier := 1
 	value := 0
 
 	for range 4 {
-		var encodedByte [1]byte
-		if _, err := r.Read(encodedByte[:]); err != nil {
+		encodedByte, err := r.ReadByte()
+		if err != nil {
 			return 0, err
 		}
 
-		digit := int(encodedByte[0])
+		digit := int(encodedByte)
 		value += (digit & 127) * multiplier
 
 		if digit&128 == 0 {
@@ -252,23 +730,183 @@ func decodeRemainingLength(r io.Reader) (int, error) {
 		multiplier *= 128
 	}
 
-	return 0, io.ErrUnexpectedEOF
+	return 0, errors.New("malformed remaining length")
+}
+
+// parseRemainingLength decodes the Remaining Length at the start of b and
+// returns it with the number of bytes it took.
+func parseRemainingLength(b []byte) (int, int, error) {
+	value := 0
+	for i := range 4 {
+		if i == len(b) {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+
+		value |= int(b[i]&127) << (7 * i)
+		if b[i]&128 == 0 {
+			return value, i + 1, nil
+		}
+	}
+
+	return 0, 0, errors.New("malformed remaining length")
 }
 
-// readUTF8String reads a UTF-8 encoded string from the given io.Reader.
+// decoder reads the fields of a packet body held in memory.
 //
-// The function will return an error if the packet is malformed, or if
-// the end of the packet is reached before the integer is complete.
-func readUTF8String(r io.Reader) (string, error) {
-	var length uint16
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+// Binary fields and payloads point into buf unless copyBytes is set, in
+// which case they are copied so buf can be reused for the next packet.
+// Topic names go through intern when it is set.
+type decoder struct {
+	buf []byte
+	pos int
+
+	// version is the protocol version of the connection; a zero value
+	// stands for MQTT 3.1.1.
+	version byte
+
+	copyBytes bool
+	intern    func([]byte) string
+}
+
+// remaining returns the number of bytes left in the packet body.
+func (d *decoder) remaining() int {
+	return len(d.buf) - d.pos
+}
+
+// next returns the next n bytes of the body, or io.ErrUnexpectedEOF if the
+// body ends before them.
+func (d *decoder) next(n int) ([]byte, error) {
+	if d.remaining() < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readVarInt reads a variable byte integer.
+func (d *decoder) readVarInt() (int, error) {
+	value, n, err := parseRemainingLength(d.buf[d.pos:])
+	if err != nil {
+		return 0, err
+	}
+
+	d.pos += n
+	return value, nil
+}
+
+func (d *decoder) readUint16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// readPacketID reads a packet identifier, which must not be zero.
+func (d *decoder) readPacketID() (uint16, error) {
+	packetID, err := d.readUint16()
+	if err != nil {
+		return 0, err
+	}
+
+	if packetID == 0 {
+		return 0, errors.New("invalid packet identifier")
+	}
+
+	return packetID, nil
+}
+
+// readField reads a field prefixed by its two byte length, without copying.
+func (d *decoder) readField() ([]byte, error) {
+	length, err := d.readUint16()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.next(int(length))
+}
+
+// readString reads a length-prefixed UTF-8 string.
+func (d *decoder) readString() (string, error) {
+	b, err := d.readField()
+	if err != nil {
 		return "", err
 	}
 
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
+	return string(b), nil
+}
+
+// readTopic reads a length-prefixed topic name, interning it if the
+// decoder has an intern function.
+func (d *decoder) readTopic() (string, error) {
+	b, err := d.readField()
+	if err != nil {
 		return "", err
 	}
 
-	return string(buf), nil
+	if d.intern != nil {
+		return d.intern(b), nil
+	}
+
+	return string(b), nil
+}
+
+// readBinary reads length-prefixed binary data.
+func (d *decoder) readBinary() ([]byte, error) {
+	b, err := d.readField()
+	if err != nil {
+		return nil, err
+	}
+
+	return d.own(b), nil
+}
+
+// readRest reads everything left in the body, such as a PUBLISH payload.
+func (d *decoder) readRest() []byte {
+	b := d.buf[d.pos:]
+	d.pos = len(d.buf)
+
+	return d.own(b)
+}
+
+// own returns b, or a copy of it when the body buffer is going to be reused.
+func (d *decoder) own(b []byte) []byte {
+	if !d.copyBytes {
+		return b
+	}
+
+	return append([]byte(nil), b...)
+}
+
+// singleByteReader reads one byte at a time from r, so that reading a
+// fixed header never consumes bytes that belong to the packet body.
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(s.r, s.buf[:]); err != nil {
+		return 0, err
+	}
+	return s.buf[0], nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for reads that
+// happen after the first byte of a packet.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
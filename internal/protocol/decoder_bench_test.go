@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchStream returns n QoS 1 PUBLISH packets written back to back.
+func benchStream(b *testing.B, n int) []byte {
+	var buf bytes.Buffer
+	for i := range n {
+		err := Encode(&buf, &PublishPacket{
+			Topic:    "sensors/building-1/floor-2/temp",
+			Payload:  []byte(`{"value":25.3,"unit":"C"}`),
+			QoS:      1,
+			PacketID: uint16(i%65535 + 1),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+const benchPackets = 1000
+
+// decodeBufio decodes a packet the way Decode did before Reader existed,
+// as a baseline for the other benchmarks: through a bufio.Reader created
+// for the call, which allocates its buffer every time and drops whatever
+// it read past the packet. Packets must therefore come one per reader.
+func decodeBufio(r io.Reader) (Packet, error) {
+	br := bufio.NewReader(r)
+
+	header, remainingLength, err := readFixedHeader(br, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, remainingLength)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	return decodePacket(header, &decoder{buf: body})
+}
+
+func BenchmarkDecodeBufio(b *testing.B) {
+	stream := benchStream(b, benchPackets)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	var frames [][]byte
+	for rest := stream; len(rest) > 0; {
+		_, n, err := DecodeBytes(rest)
+		if err != nil {
+			b.Fatal(err)
+		}
+		frames, rest = append(frames, rest[:n]), rest[n:]
+	}
+
+	var r bytes.Reader
+	for b.Loop() {
+		for _, frame := range frames {
+			r.Reset(frame)
+			if _, err := decodeBufio(&r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	stream := benchStream(b, benchPackets)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		r := bytes.NewReader(stream)
+		for {
+			if _, err := Decode(r); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	stream := benchStream(b, benchPackets)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		r := NewReader(bytes.NewReader(stream))
+		for {
+			if _, err := r.ReadPacket(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeBytes(b *testing.B) {
+	stream := benchStream(b, benchPackets)
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		for rest := stream; len(rest) > 0; {
+			_, n, err := DecodeBytes(rest)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+	}
+}
@@ -85,3 +85,227 @@ func TestDecodeConnect(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodePublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+		check   func(t *testing.T, pkt Packet)
+	}{
+		{
+			name: "QoS 0",
+			input: []byte{
+				0x30, 0x07,
+				0x00, 0x03, 'a', '/', 'b',
+				'h', 'i',
+			},
+			check: func(t *testing.T, pkt Packet) {
+				pub, ok := pkt.(*PublishPacket)
+				require.True(t, ok, "expected PublishPacket")
+
+				assert.Equal(t, "a/b", pub.Topic)
+				assert.Equal(t, []byte("hi"), pub.Payload)
+				assert.Equal(t, byte(0), pub.QoS)
+				assert.Equal(t, uint16(0), pub.PacketID)
+			},
+		},
+		{
+			name: "QoS 1 with DUP",
+			input: []byte{
+				0x3A, 0x09,
+				0x00, 0x03, 'a', '/', 'b',
+				0x00, 0x2A,
+				'h', 'i',
+			},
+			check: func(t *testing.T, pkt Packet) {
+				pub, ok := pkt.(*PublishPacket)
+				require.True(t, ok, "expected PublishPacket")
+
+				assert.Equal(t, "a/b", pub.Topic)
+				assert.Equal(t, []byte("hi"), pub.Payload)
+				assert.Equal(t, byte(1), pub.QoS)
+				assert.True(t, pub.Dup)
+				assert.Equal(t, uint16(42), pub.PacketID)
+			},
+		},
+		{
+			name: "QoS 1 with zero packet identifier",
+			input: []byte{
+				0x32, 0x07,
+				0x00, 0x03, 'a', '/', 'b',
+				0x00, 0x00,
+			},
+			wantErr: true,
+		},
+		{
+			name: "DUP set on QoS 0",
+			input: []byte{
+				0x38, 0x05,
+				0x00, 0x03, 'a', '/', 'b',
+			},
+			wantErr: true,
+		},
+		{
+			name: "wildcard in topic name",
+			input: []byte{
+				0x30, 0x05,
+				0x00, 0x03, 'a', '/', '#',
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid QoS 3",
+			input: []byte{
+				0x36, 0x07,
+				0x00, 0x03, 'a', '/', 'b',
+				0x00, 0x01,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := Decode(bytes.NewReader(tt.input))
+
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NotNil(t, pkt)
+
+			if tt.check != nil {
+				tt.check(t, pkt)
+			}
+		})
+	}
+}
+
+func TestDecodePubAck(t *testing.T) {
+	pkt, err := Decode(bytes.NewReader([]byte{0x40, 0x02, 0x01, 0x02}))
+	require.NoError(t, err)
+
+	ack, ok := pkt.(*PubAckPacket)
+	require.True(t, ok, "expected PubAckPacket")
+	assert.Equal(t, uint16(0x0102), ack.PacketID)
+
+	_, err = Decode(bytes.NewReader([]byte{0x40, 0x03, 0x01, 0x02, 0x03}))
+	require.Error(t, err)
+}
+
+func TestDecodeQoS2Acks(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		want    Packet
+		wantErr bool
+	}{
+		{name: "PUBREC", input: []byte{0x50, 0x02, 0x00, 0x05}, want: &PubRecPacket{PacketID: 5}},
+		{name: "PUBREL", input: []byte{0x62, 0x02, 0x00, 0x05}, want: &PubRelPacket{PacketID: 5}},
+		{name: "PUBCOMP", input: []byte{0x70, 0x02, 0x00, 0x05}, want: &PubCompPacket{PacketID: 5}},
+		{name: "PUBREL without reserved flags", input: []byte{0x60, 0x02, 0x00, 0x05}, wantErr: true},
+		{name: "PUBREC with zero packet identifier", input: []byte{0x50, 0x02, 0x00, 0x00}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := Decode(bytes.NewReader(tt.input))
+
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, pkt)
+		})
+	}
+}
+
+func TestDecodeUnsubscribe(t *testing.T) {
+	pkt, err := Decode(bytes.NewReader([]byte{
+		0xA2, 0x0B,
+		0x00, 0x03,
+		0x00, 0x03, 'a', '/', '+',
+		0x00, 0x02, 'b', '#',
+	}))
+	require.NoError(t, err)
+
+	unsub, ok := pkt.(*UnsubscribePacket)
+	require.True(t, ok, "expected UnsubscribePacket")
+	assert.Equal(t, uint16(3), unsub.PacketID)
+	assert.Equal(t, []string{"a/+", "b#"}, unsub.Topics)
+
+	_, err = Decode(bytes.NewReader([]byte{0xA2, 0x02, 0x00, 0x03}))
+	require.Error(t, err, "UNSUBSCRIBE without topics")
+
+	_, err = Decode(bytes.NewReader([]byte{0xA0, 0x05, 0x00, 0x03, 0x00, 0x01, 'a'}))
+	require.Error(t, err, "UNSUBSCRIBE without reserved flags")
+}
+
+func TestDecodeConnectWill(t *testing.T) {
+	pkt, err := Decode(bytes.NewReader([]byte{
+		0x10, 0x1A,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x04,
+		0x36, // will retain, will QoS 2, will flag, clean session
+		0x00, 0x3C,
+		0x00, 0x01, 'c',
+		0x00, 0x06, 'd', 'e', 'v', '/', 'u', 'p',
+		0x00, 0x03, 'o', 'f', 'f',
+	}))
+	require.NoError(t, err)
+
+	conn, ok := pkt.(*ConnectPacket)
+	require.True(t, ok, "expected ConnectPacket")
+	assert.True(t, conn.WillFlag)
+	assert.Equal(t, "dev/up", conn.WillTopic)
+	assert.Equal(t, []byte("off"), conn.WillMessage)
+	assert.Equal(t, byte(2), conn.WillQoS)
+	assert.True(t, conn.WillRetain)
+
+	_, err = Decode(bytes.NewReader([]byte{
+		0x10, 0x0F,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x04,
+		0x22, // will retain without will flag
+		0x00, 0x3C,
+		0x00, 0x01, 'c',
+	}))
+	require.Error(t, err)
+}
+
+func TestDecodeConnectCredentials(t *testing.T) {
+	pkt, err := Decode(bytes.NewReader([]byte{
+		0x10, 0x19,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x04,
+		0xC2, // username, password, clean session
+		0x00, 0x3C,
+		0x00, 0x01, 'c',
+		0x00, 0x04, 'u', 's', 'e', 'r',
+		0x00, 0x04, 'p', 'a', 's', 's',
+	}))
+	require.NoError(t, err)
+
+	conn, ok := pkt.(*ConnectPacket)
+	require.True(t, ok, "expected ConnectPacket")
+	require.NotNil(t, conn.Username)
+	require.NotNil(t, conn.Password)
+	assert.Equal(t, "user", *conn.Username)
+	assert.Equal(t, "pass", *conn.Password)
+
+	_, err = Decode(bytes.NewReader([]byte{
+		0x10, 0x13,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x04,
+		0x42, // password without username
+		0x00, 0x3C,
+		0x00, 0x01, 'c',
+		0x00, 0x04, 'p', 'a', 's', 's',
+	}))
+	require.Error(t, err)
+}
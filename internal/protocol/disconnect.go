@@ -3,8 +3,12 @@ package protocol
 // DisconnectPacket is a DISCONNECT packet sent from the client to the server
 // and is used to indicate that the client is disconnecting from the server.
 //
-// It has no payload.
-type DisconnectPacket struct{}
+// It has no payload. MQTT 5 adds a reason code and properties, and lets
+// the server send it too.
+type DisconnectPacket struct {
+	ReasonCode ReasonCode
+	Properties *Properties
+}
 
 func (d *DisconnectPacket) Type() PacketType {
 	return PacketTypeDisconnect
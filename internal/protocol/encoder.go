@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -8,16 +9,74 @@ import (
 
 var ErrUnsupportedPacket = errors.New("unsupported packet type")
 
-// Encode writes a packet to the given io.Writer. It returns an error
-// if the packet type is not supported.
+// ErrPacketTooLarge is returned when a packet is larger than the Remaining
+// Length field can describe, or than the maximum packet size allowed by
+// the receiver.
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// ErrFieldTooLong is returned when a string or binary field does not fit
+// in the two byte length that prefixes it on the wire.
+var ErrFieldTooLong = errors.New("field longer than 65535 bytes")
+
+// maxRemainingLength is the largest value the four byte Remaining Length
+// field can hold.
+const maxRemainingLength = 268435455
+
+// Encode writes a packet to the given io.Writer in the MQTT 3.1.1 format.
+// It returns an error if the packet type is not supported.
+//
+// Every MQTT 3.1.1 packet type can be encoded, in either direction, so the
+// package can be used by clients and bridges as well as by the server.
 func Encode(w io.Writer, p Packet) error {
+	return EncodeVersion(w, p, Version311)
+}
+
+// EncodeVersion works like Encode, but writes the packet in the format of
+// the given protocol version, Version311 or Version5.
+//
+// MQTT 3.1.1 has no properties and reason codes, so they are left out of
+// packets encoded for it. AUTH packets only exist in MQTT 5. A CONNECT is
+// always written for its own ProtocolLevel, or for version when it is zero.
+func EncodeVersion(w io.Writer, p Packet, version byte) error {
+	v5 := version == Version5
+
 	switch pkt := p.(type) {
+	case *ConnectPacket:
+		return encodeConnect(w, pkt, version)
 	case *ConnAckPacket:
-		return encodeConnAck(w, pkt)
+		return encodeConnAck(w, pkt, v5)
 	case *PingRespPacket:
 		return encodePingResp(w)
 	case *SubAckPacket:
-		return encodeSubAck(w, pkt)
+		return encodeSubAck(w, pkt, v5)
+	case *UnsubAckPacket:
+		return encodeUnsubAck(w, pkt, v5)
+	case *PublishPacket:
+		return encodePublish(w, pkt, v5)
+	case *PubAckPacket:
+		return encodeAck(w, 0x40, pkt.PacketID, pkt.ReasonCode, pkt.Properties, v5)
+	case *PubRecPacket:
+		return encodeAck(w, 0x50, pkt.PacketID, pkt.ReasonCode, pkt.Properties, v5)
+	case *PubRelPacket:
+		return encodeAck(w, 0x62, pkt.PacketID, pkt.ReasonCode, pkt.Properties, v5)
+	case *PubCompPacket:
+		return encodeAck(w, 0x70, pkt.PacketID, pkt.ReasonCode, pkt.Properties, v5)
+	case *SubscribePacket:
+		return encodeSubscribe(w, pkt, v5)
+	case *UnsubscribePacket:
+		return encodeUnsubscribe(w, pkt, v5)
+	case *PingReqPacket:
+		return writeFixedHeader(w, 0xC0, 0)
+	case *DisconnectPacket:
+		if !v5 {
+			return writeFixedHeader(w, 0xE0, 0)
+		}
+		return encodeReason(w, 0xE0, pkt.ReasonCode, pkt.Properties)
+	case *AuthPacket:
+		if !v5 {
+			return ErrUnsupportedPacket
+		}
+		return encodeReason(w, 0xF0, pkt.ReasonCode, pkt.Properties)
 	default:
 		return ErrUnsupportedPacket
 	}
@@ -33,87 +92,389 @@ func Encode(w io.Writer, p Packet) error {
 // The function is intended for use by the OrbMQ server only.
 // It is not intended for use by clients.
 func EncodePublish(w io.Writer, topic string, payload []byte) error {
-	remainingLength := 2 + len(topic) + len(payload)
+	return encodePublish(w, &PublishPacket{
+		Topic:   topic,
+		Payload: payload,
+	}, false)
+}
 
-	// Fixed header
-	if _, err := w.Write([]byte{
-		0x30,
-		byte(remainingLength),
-	}); err != nil {
-		return err
+// encodePublish writes a PUBLISH packet to the given io.Writer. The QoS,
+// DUP and RETAIN flags are taken from the packet, and the packet identifier is
+// only written for QoS 1 and QoS 2 packets. MQTT 5 packets carry the
+// properties of the message after it.
+//
+// The payload is written as it is, without being copied into the buffer
+// holding the rest of the packet.
+//
+// The function returns an error if the write operation fails.
+func encodePublish(w io.Writer, pkt *PublishPacket, v5 bool) error {
+	if pkt.QoS > 2 {
+		return errors.New("invalid QoS level")
+	}
+
+	var e encoder
+
+	// Variable header
+	e.writeString(pkt.Topic)
+	if pkt.QoS > 0 {
+		e.writeUint16(pkt.PacketID)
+	}
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypePublish)
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	header := byte(PacketTypePublish)<<4 | pkt.QoS<<1
+	if pkt.Dup {
+		header |= 0x08
+	}
+	if pkt.Retain {
+		header |= 0x01
 	}
 
-	// Topic
-	if err := binary.Write(w, binary.BigEndian, uint16(len(topic))); err != nil {
+	if err := writeFixedHeader(w, header, len(e.buf)+len(pkt.Payload)); err != nil {
 		return err
 	}
-	if _, err := w.Write([]byte(topic)); err != nil {
+	if _, err := w.Write(e.buf); err != nil {
 		return err
 	}
 
 	// Payload
-	_, err := w.Write(payload)
+	_, err := w.Write(pkt.Payload)
 	return err
 }
 
-// EncodeConnAck writes a CONNACK packet to the given io.Writer. The
-// packet will contain the given session present flag and return code.
+// encodeConnect writes a CONNECT packet to the given io.Writer. The connect
+// flags are built from the packet: the will is only written when WillFlag is
+// set, and the username and password when they are not nil.
 //
-// The function returns an error if the write operation fails.
+// An empty ProtocolName stands for "MQTT", and a zero ProtocolLevel for
+// the given version, or MQTT 3.1.1 when it is zero too. Properties are only
+// written for MQTT 5.
 //
-// The function is intended for use by the OrbMQ server only.
-// It is not intended for use by clients.
-func encodeConnAck(w io.Writer, pkt *ConnAckPacket) error {
-	// Fixed Header
-	if _, err := w.Write([]byte{0x20, 0x02}); err != nil {
-		return err
+// The function returns an error if a field is too long or the write
+// operation fails.
+func encodeConnect(w io.Writer, pkt *ConnectPacket, version byte) error {
+	name, level := pkt.ProtocolName, cmp.Or(pkt.ProtocolLevel, version, Version311)
+	if name == "" {
+		name = "MQTT"
 	}
+	v5 := level == Version5
 
-	var flags byte = 0x00
-	if pkt.SessionPresent {
-		flags = 0x01
+	var flags byte
+	if pkt.CleanSession {
+		flags |= 0x02
+	}
+	if pkt.WillFlag {
+		flags |= 0x04 | pkt.WillQoS<<3
+		if pkt.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if pkt.Password != nil {
+		flags |= 0x40
+	}
+	if pkt.Username != nil {
+		flags |= 0x80
 	}
 
-	_, err := w.Write([]byte{
-		flags,
-		byte(pkt.ReturnCode),
-	})
+	var e encoder
 
-	return err
+	// Variable header
+	e.writeString(name)
+	e.writeByte(level)
+	e.writeByte(flags)
+	e.writeUint16(pkt.KeepAlive)
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeConnect)
+	}
+
+	// Payload
+	e.writeString(pkt.ClientID)
+	if pkt.WillFlag {
+		if v5 {
+			e.writeProperties(pkt.WillProperties, willProperties)
+		}
+		e.writeString(pkt.WillTopic)
+		e.writeBinary(pkt.WillMessage)
+	}
+	if pkt.Username != nil {
+		e.writeString(*pkt.Username)
+	}
+	if pkt.Password != nil {
+		e.writeString(*pkt.Password)
+	}
+
+	return e.writeTo(w, 0x10)
+}
+
+// encodeSubscribe writes a SUBSCRIBE packet to the given io.Writer, with
+// the packet identifier followed by each topic filter and its QoS. For
+// MQTT 5, the properties follow the packet identifier and the QoS byte also
+// holds the other subscription options.
+//
+// The function returns an error if a field is too long or the write
+// operation fails.
+func encodeSubscribe(w io.Writer, pkt *SubscribePacket, v5 bool) error {
+	var e encoder
+
+	e.writeUint16(pkt.PacketID)
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeSubscribe)
+	}
+	for _, sub := range pkt.Subscriptions {
+		e.writeString(sub.Topic)
+		if !v5 {
+			e.writeByte(sub.QoS)
+			continue
+		}
+
+		options := sub.QoS | sub.RetainHandling<<4
+		if sub.NoLocal {
+			options |= 0x04
+		}
+		if sub.RetainAsPublished {
+			options |= 0x08
+		}
+		e.writeByte(options)
+	}
+
+	return e.writeTo(w, 0x82)
+}
+
+// encodeUnsubscribe writes an UNSUBSCRIBE packet to the given io.Writer,
+// with the packet identifier followed by the topic filters, and for MQTT 5
+// the properties in between.
+//
+// The function returns an error if a field is too long or the write
+// operation fails.
+func encodeUnsubscribe(w io.Writer, pkt *UnsubscribePacket, v5 bool) error {
+	var e encoder
+
+	e.writeUint16(pkt.PacketID)
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeUnsubscribe)
+	}
+	for _, topic := range pkt.Topics {
+		e.writeString(topic)
+	}
+
+	return e.writeTo(w, 0xA2)
+}
+
+// EncodeConnAck writes a CONNACK packet to the given io.Writer. The
+// packet will contain the given session present flag and return code, and
+// for MQTT 5 the properties.
+//
+// The function returns an error if the write operation fails.
+func encodeConnAck(w io.Writer, pkt *ConnAckPacket, v5 bool) error {
+	var e encoder
+
+	e.writeByte(boolByte(pkt.SessionPresent))
+	e.writeByte(byte(pkt.ReturnCode))
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeConnAck)
+	}
+
+	return e.writeTo(w, 0x20)
 }
 
 // EncodePingResp writes a PINGRESP packet to the given io.Writer.
 // The packet has no payload and is used to respond to a PINGREQ packet.
 // The function returns an error if the write operation fails.
 func encodePingResp(w io.Writer) error {
-	_, err := w.Write([]byte{0xD0, 0x00})
-	return err
+	return writeFixedHeader(w, 0xD0, 0)
 }
 
 // EncodeSubAck writes a SUBACK packet to the given io.Writer. The
-// packet will contain the given packet identifier and return codes.
+// packet will contain the given packet identifier and return codes, and
+// for MQTT 5 the properties in between.
+//
+// The function returns an error if the write operation fails.
+func encodeSubAck(w io.Writer, pkt *SubAckPacket, v5 bool) error {
+	var e encoder
+
+	e.writeUint16(pkt.PacketID)
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeSubAck)
+	}
+	e.buf = append(e.buf, pkt.ReturnCodes...)
+
+	return e.writeTo(w, 0x90)
+}
+
+// encodeUnsubAck writes an UNSUBACK packet to the given io.Writer. MQTT 3.1.1
+// packets only carry the packet identifier, MQTT 5 packets also carry the
+// properties and one reason code per topic filter.
 //
 // The function returns an error if the write operation fails.
+func encodeUnsubAck(w io.Writer, pkt *UnsubAckPacket, v5 bool) error {
+	var e encoder
+
+	e.writeUint16(pkt.PacketID)
+	if v5 {
+		e.writeProperties(pkt.Properties, PacketTypeUnsubAck)
+		for _, code := range pkt.ReasonCodes {
+			e.writeByte(byte(code))
+		}
+	}
+
+	return e.writeTo(w, 0xB0)
+}
+
+// encodeAck writes a PUBACK, PUBREC, PUBREL or PUBCOMP packet to the given
+// io.Writer. These packets only differ in their first header byte, which
+// is passed in, and carry the given packet identifier.
 //
-// The function is intended for use by the OrbMQ server only.
-// It is not intended for use by clients.
-func encodeSubAck(w io.Writer, pkt *SubAckPacket) error {
-	remainingLength := 2 + len(pkt.ReturnCodes)
-
-	// Fixed header
-	if _, err := w.Write([]byte{
-		0x90, // SUBACK
-		byte(remainingLength),
-	}); err != nil {
-		return err
+// MQTT 5 packets also carry a reason code and properties. Both are left
+// out when the packet is a plain success, as the specification allows.
+//
+// The function returns an error if the write operation fails.
+func encodeAck(w io.Writer, header byte, packetID uint16, code ReasonCode, props *Properties, v5 bool) error {
+	var e encoder
+
+	e.writeUint16(packetID)
+	if v5 && (code != ReasonSuccess || props != nil) {
+		e.writeByte(byte(code))
+		e.writeProperties(props, PacketType(header>>4))
 	}
 
-	// Packet Identifier
-	if err := binary.Write(w, binary.BigEndian, pkt.PacketID); err != nil {
+	return e.writeTo(w, header)
+}
+
+// encodeReason writes an MQTT 5 DISCONNECT or AUTH packet, which hold a
+// reason code and properties. A success without properties is written as
+// an empty packet, as the specification allows.
+//
+// The function returns an error if the write operation fails.
+func encodeReason(w io.Writer, header byte, code ReasonCode, props *Properties) error {
+	var e encoder
+
+	if code != ReasonSuccess || props != nil {
+		e.writeByte(byte(code))
+		e.writeProperties(props, PacketType(header>>4))
+	}
+
+	return e.writeTo(w, header)
+}
+
+// encoder builds the body of a packet in memory, so its Remaining Length is
+// known before anything is written. The first error is kept and every
+// later write is ignored.
+type encoder struct {
+	buf []byte
+	err error
+}
+
+func (e *encoder) writeByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) writeUint16(v uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+// writeVarInt writes a variable byte integer, encoded like the Remaining
+// Length.
+func (e *encoder) writeVarInt(n int) {
+	if n < 0 || n > maxRemainingLength {
+		e.err = cmp.Or(e.err, ErrPacketTooLarge)
+		return
+	}
+
+	e.buf = appendRemainingLength(e.buf, n)
+}
+
+// writeString writes a UTF-8 string prefixed by its two byte length.
+func (e *encoder) writeString(s string) {
+	if len(s) > 65535 {
+		e.err = cmp.Or(e.err, ErrFieldTooLong)
+		return
+	}
+
+	e.writeUint16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// writeBinary writes binary data prefixed by its two byte length.
+func (e *encoder) writeBinary(b []byte) {
+	if len(b) > 65535 {
+		e.err = cmp.Or(e.err, ErrFieldTooLong)
+		return
+	}
+
+	e.writeUint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// writeTo writes the packet to w, starting with the fixed header.
+func (e *encoder) writeTo(w io.Writer, header byte) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	if err := writeFixedHeader(w, header, len(e.buf)); err != nil {
 		return err
 	}
 
-	// Return codes
-	_, err := w.Write(pkt.ReturnCodes)
+	_, err := w.Write(e.buf)
 	return err
 }
+
+// writeFixedHeader writes the fixed header of a packet: the byte holding
+// the packet type and flags, followed by the Remaining Length.
+//
+// The function returns ErrPacketTooLarge if the remaining length cannot be
+// encoded, or an error if the write operation fails.
+func writeFixedHeader(w io.Writer, header byte, remainingLength int) error {
+	if remainingLength < 0 || remainingLength > maxRemainingLength {
+		return ErrPacketTooLarge
+	}
+
+	buf := make([]byte, 1, 5)
+	buf[0] = header
+	buf = appendRemainingLength(buf, remainingLength)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// appendRemainingLength appends the variable-length encoding of n to b.
+// Each byte carries seven bits of the value, least significant first, and
+// the high bit is set on every byte but the last one.
+func appendRemainingLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// remainingLengthSize returns the number of bytes appendRemainingLength
+// uses to encode n.
+func remainingLengthSize(n int) int {
+	switch {
+	case n < 128:
+		return 1
+	case n < 16384:
+		return 2
+	case n < 2097152:
+		return 3
+	default:
+		return 4
+	}
+}
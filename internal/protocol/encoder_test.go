@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendRemainingLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xFF, 0xFF, 0x7F}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+	}
+
+	for _, tt := range tests {
+		got := appendRemainingLength(nil, tt.n)
+		assert.Equal(t, tt.want, got, "n=%d", tt.n)
+		assert.Equal(t, len(got), remainingLengthSize(tt.n), "n=%d", tt.n)
+
+		n, err := decodeRemainingLength(bytes.NewReader(got))
+		require.NoError(t, err)
+		assert.Equal(t, tt.n, n)
+	}
+}
+
+func TestEncodeLargePublish(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xAB}, 20000)
+
+	var buf bytes.Buffer
+	require.NoError(t, Encode(&buf, &PublishPacket{
+		Topic:    "big/payload",
+		Payload:  payload,
+		QoS:      1,
+		PacketID: 9,
+	}))
+
+	pkt, err := Decode(&buf)
+	require.NoError(t, err)
+
+	pub, ok := pkt.(*PublishPacket)
+	require.True(t, ok, "expected PublishPacket")
+	assert.Equal(t, "big/payload", pub.Topic)
+	assert.Equal(t, payload, pub.Payload)
+	assert.Equal(t, uint16(9), pub.PacketID)
+}
+
+func TestDecodeLimit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, EncodePublish(&buf, "a", make([]byte, 200)))
+	frame := buf.Bytes()
+
+	_, err := DecodeLimit(bytes.NewReader(frame), len(frame))
+	require.NoError(t, err)
+
+	_, err = DecodeLimit(bytes.NewReader(frame), len(frame)-1)
+	require.ErrorIs(t, err, ErrPacketTooLarge)
+
+	// The limit applies before the body is read, so a huge announced
+	// length is refused without waiting for the bytes.
+	_, err = DecodeLimit(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}), 1024)
+	require.ErrorIs(t, err, ErrPacketTooLarge)
+}
+
+func TestDecodeLargeBody(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, EncodePublish(&buf, "a", bytes.Repeat([]byte{'x'}, 3*maxEagerBody)))
+	frame := buf.Bytes()
+
+	p, err := Decode(bytes.NewReader(frame))
+	require.NoError(t, err)
+	assert.Len(t, p.(*PublishPacket).Payload, 3*maxEagerBody)
+
+	p, err = NewReader(bytes.NewReader(frame)).ReadPacket()
+	require.NoError(t, err)
+	assert.Len(t, p.(*PublishPacket).Payload, 3*maxEagerBody)
+
+	// Without a limit, memory follows the bytes that arrive, not the
+	// announced length.
+	header := []byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F, 0x00, 0x01, 'a'}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = Decode(bytes.NewReader(header))
+	runtime.ReadMemStats(&after)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	_, err = NewReader(bytes.NewReader(header)).ReadPacket()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
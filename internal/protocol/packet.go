@@ -3,14 +3,27 @@ package protocol
 type PacketType byte
 
 const (
-	PacketTypeConnect    PacketType = 1
-	PacketTypeConnAck    PacketType = 2
-	PacketTypePublish    PacketType = 3
-	PacketTypeSubscribe  PacketType = 8
-	PacketTypeSubAck     PacketType = 9
-	PacketTypePingReq    PacketType = 12
-	PacketTypePingResp   PacketType = 13
-	PacketTypeDisconnect PacketType = 14
+	PacketTypeConnect     PacketType = 1
+	PacketTypeConnAck     PacketType = 2
+	PacketTypePublish     PacketType = 3
+	PacketTypePubAck      PacketType = 4
+	PacketTypePubRec      PacketType = 5
+	PacketTypePubRel      PacketType = 6
+	PacketTypePubComp     PacketType = 7
+	PacketTypeSubscribe   PacketType = 8
+	PacketTypeSubAck      PacketType = 9
+	PacketTypeUnsubscribe PacketType = 10
+	PacketTypeUnsubAck    PacketType = 11
+	PacketTypePingReq     PacketType = 12
+	PacketTypePingResp    PacketType = 13
+	PacketTypeDisconnect  PacketType = 14
+	PacketTypeAuth        PacketType = 15
+)
+
+// Protocol levels of the supported MQTT versions, as sent in CONNECT.
+const (
+	Version311 byte = 0x04
+	Version5   byte = 0x05
 )
 
 type Packet interface {
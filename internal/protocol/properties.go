@@ -0,0 +1,470 @@
+package protocol
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Properties are the MQTT 5 properties of a packet. Which ones a packet
+// may carry depends on its type; the others stay at their zero value.
+//
+// MQTT 3.1.1 has no way to send them and the encoder leaves them out, but
+// message properties still travel with the message inside the broker, for
+// example from an in-process publisher to an in-process subscriber.
+//
+// Optional numeric properties are pointers, nil when they are absent.
+type Properties struct {
+	// PayloadFormat is 1 when the payload is UTF-8 encoded character data,
+	// and 0 for unspecified bytes.
+	PayloadFormat byte
+
+	// MessageExpiry is the lifetime of the message in seconds, or nil if it
+	// does not expire.
+	MessageExpiry *uint32
+
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+
+	// TopicAlias stands for the topic name of a PUBLISH.
+	TopicAlias *uint16
+
+	// SubscriptionIdentifiers identify the subscriptions a PUBLISH matched,
+	// or hold the single identifier given in a SUBSCRIBE.
+	SubscriptionIdentifiers []uint32
+
+	// WillDelay is the number of seconds the server waits before publishing
+	// a will. It is only sent with the will properties of a CONNECT.
+	WillDelay *uint32
+
+	// SessionExpiry is the number of seconds a session outlives its network
+	// connection.
+	SessionExpiry *uint32
+
+	AssignedClientID string
+	ServerKeepAlive  *uint16
+
+	AuthMethod string
+	AuthData   []byte
+
+	RequestProblemInfo  *bool
+	RequestResponseInfo *bool
+	ResponseInfo        string
+	ServerReference     string
+	ReasonString        string
+
+	ReceiveMaximum    *uint16
+	TopicAliasMaximum *uint16
+	MaximumQoS        *byte
+	RetainAvailable   *bool
+	MaximumPacketSize *uint32
+
+	WildcardSubAvailable *bool
+	SubIDAvailable       *bool
+	SharedSubAvailable   *bool
+
+	UserProperties []UserProperty
+}
+
+// UserProperty is a name and value pair defined by the application. The
+// same name may appear more than once.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Property identifiers.
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionID       = 0x0B
+	propSessionExpiry        = 0x11
+	propAssignedClientID     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1A
+	propServerReference      = 0x1C
+	propReasonString         = 0x1F
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQoS           = 0x24
+	propRetainAvailable      = 0x25
+	propUserProperty         = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardSubAvailable = 0x28
+	propSubIDAvailable       = 0x29
+	propSharedSubAvailable   = 0x2A
+)
+
+// maxSubscriptionID is the largest subscription identifier, the largest
+// value of a variable byte integer.
+const maxSubscriptionID = maxRemainingLength
+
+// willProperties stands for the will properties of a CONNECT in
+// propertyPackets. Packet type 0 is reserved, so it cannot clash with a
+// real packet.
+const willProperties PacketType = 0
+
+// propertyPackets holds, for each property identifier, the set of packet
+// types that may carry it as a bit mask.
+var propertyPackets = [...]uint16{
+	propPayloadFormat:        packets(PacketTypePublish, willProperties),
+	propMessageExpiry:        packets(PacketTypePublish, willProperties),
+	propContentType:          packets(PacketTypePublish, willProperties),
+	propResponseTopic:        packets(PacketTypePublish, willProperties),
+	propCorrelationData:      packets(PacketTypePublish, willProperties),
+	propSubscriptionID:       packets(PacketTypePublish, PacketTypeSubscribe),
+	propSessionExpiry:        packets(PacketTypeConnect, PacketTypeConnAck, PacketTypeDisconnect),
+	propAssignedClientID:     packets(PacketTypeConnAck),
+	propServerKeepAlive:      packets(PacketTypeConnAck),
+	propAuthMethod:           packets(PacketTypeConnect, PacketTypeConnAck, PacketTypeAuth),
+	propAuthData:             packets(PacketTypeConnect, PacketTypeConnAck, PacketTypeAuth),
+	propRequestProblemInfo:   packets(PacketTypeConnect),
+	propWillDelay:            packets(willProperties),
+	propRequestResponseInfo:  packets(PacketTypeConnect),
+	propResponseInfo:         packets(PacketTypeConnAck),
+	propServerReference:      packets(PacketTypeConnAck, PacketTypeDisconnect),
+	propReasonString:         packets(PacketTypeConnAck, PacketTypePubAck, PacketTypePubRec, PacketTypePubRel, PacketTypePubComp, PacketTypeSubAck, PacketTypeUnsubAck, PacketTypeDisconnect, PacketTypeAuth),
+	propReceiveMaximum:       packets(PacketTypeConnect, PacketTypeConnAck),
+	propTopicAliasMaximum:    packets(PacketTypeConnect, PacketTypeConnAck),
+	propTopicAlias:           packets(PacketTypePublish),
+	propMaximumQoS:           packets(PacketTypeConnAck),
+	propRetainAvailable:      packets(PacketTypeConnAck),
+	propUserProperty:         0xFFFF,
+	propMaximumPacketSize:    packets(PacketTypeConnect, PacketTypeConnAck),
+	propWildcardSubAvailable: packets(PacketTypeConnAck),
+	propSubIDAvailable:       packets(PacketTypeConnAck),
+	propSharedSubAvailable:   packets(PacketTypeConnAck),
+}
+
+func packets(types ...PacketType) uint16 {
+	var mask uint16
+	for _, t := range types {
+		mask |= 1 << t
+	}
+	return mask
+}
+
+// allowed reports whether a packet of type t may carry the property id.
+func allowed(id int, t PacketType) bool {
+	return id < len(propertyPackets) && propertyPackets[id]&(1<<t) != 0
+}
+
+// writeProperties writes the properties of a packet of type t, prefixed by
+// their length. Properties the packet type cannot carry are left out, so
+// the properties of a message can be passed on as they are.
+func (e *encoder) writeProperties(p *Properties, t PacketType) {
+	var pe encoder
+	pe.appendProperties(p, t)
+
+	e.err = cmp.Or(e.err, pe.err)
+	e.writeVarInt(len(pe.buf))
+	e.buf = append(e.buf, pe.buf...)
+}
+
+// appendProperties writes each property present in p, in identifier
+// order.
+func (e *encoder) appendProperties(p *Properties, t PacketType) {
+	if p == nil {
+		return
+	}
+
+	byteProp := func(id int, v byte) {
+		if allowed(id, t) {
+			e.writeByte(byte(id))
+			e.writeByte(v)
+		}
+	}
+	optByte := func(id int, v *byte) {
+		if v != nil {
+			byteProp(id, *v)
+		}
+	}
+	optBool := func(id int, v *bool) {
+		if v != nil {
+			byteProp(id, boolByte(*v))
+		}
+	}
+	optUint16 := func(id int, v *uint16) {
+		if v != nil && allowed(id, t) {
+			e.writeByte(byte(id))
+			e.writeUint16(*v)
+		}
+	}
+	optUint32 := func(id int, v *uint32) {
+		if v != nil && allowed(id, t) {
+			e.writeByte(byte(id))
+			e.writeUint32(*v)
+		}
+	}
+	str := func(id int, v string) {
+		if v != "" && allowed(id, t) {
+			e.writeByte(byte(id))
+			e.writeString(v)
+		}
+	}
+	bin := func(id int, v []byte) {
+		if v != nil && allowed(id, t) {
+			e.writeByte(byte(id))
+			e.writeBinary(v)
+		}
+	}
+
+	if p.PayloadFormat != 0 {
+		byteProp(propPayloadFormat, p.PayloadFormat)
+	}
+	optUint32(propMessageExpiry, p.MessageExpiry)
+	str(propContentType, p.ContentType)
+	str(propResponseTopic, p.ResponseTopic)
+	bin(propCorrelationData, p.CorrelationData)
+	if allowed(propSubscriptionID, t) {
+		for _, id := range p.SubscriptionIdentifiers {
+			if id == 0 || id > maxSubscriptionID {
+				e.err = cmp.Or(e.err, errors.New("invalid subscription identifier"))
+			}
+			e.writeByte(propSubscriptionID)
+			e.writeVarInt(int(id))
+		}
+	}
+	optUint32(propSessionExpiry, p.SessionExpiry)
+	str(propAssignedClientID, p.AssignedClientID)
+	optUint16(propServerKeepAlive, p.ServerKeepAlive)
+	str(propAuthMethod, p.AuthMethod)
+	bin(propAuthData, p.AuthData)
+	optBool(propRequestProblemInfo, p.RequestProblemInfo)
+	optUint32(propWillDelay, p.WillDelay)
+	optBool(propRequestResponseInfo, p.RequestResponseInfo)
+	str(propResponseInfo, p.ResponseInfo)
+	str(propServerReference, p.ServerReference)
+	str(propReasonString, p.ReasonString)
+	optUint16(propReceiveMaximum, p.ReceiveMaximum)
+	optUint16(propTopicAliasMaximum, p.TopicAliasMaximum)
+	optUint16(propTopicAlias, p.TopicAlias)
+	optByte(propMaximumQoS, p.MaximumQoS)
+	optBool(propRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		e.writeByte(propUserProperty)
+		e.writeString(up.Key)
+		e.writeString(up.Value)
+	}
+	optUint32(propMaximumPacketSize, p.MaximumPacketSize)
+	optBool(propWildcardSubAvailable, p.WildcardSubAvailable)
+	optBool(propSubIDAvailable, p.SubIDAvailable)
+	optBool(propSharedSubAvailable, p.SharedSubAvailable)
+}
+
+func boolByte(v bool) byte {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// readProperties reads the length-prefixed properties of a packet of type
+// t. It returns nil when there are none.
+//
+// Properties that the packet type cannot carry, duplicates of properties
+// that may only appear once and out of range values are rejected.
+func (d *decoder) readProperties(t PacketType) (*Properties, error) {
+	length, err := d.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	b, err := d.next(length)
+	if err != nil {
+		return nil, err
+	}
+	pd := &decoder{buf: b, copyBytes: d.copyBytes}
+
+	p := &Properties{}
+	var seen uint64
+
+	for pd.remaining() > 0 {
+		id, err := pd.readVarInt()
+		if err != nil {
+			return nil, err
+		}
+
+		if !allowed(id, t) {
+			return nil, fmt.Errorf("property %#x not allowed in %s", id, packetName(t))
+		}
+		if id != propUserProperty && id != propSubscriptionID {
+			if seen&(1<<id) != 0 {
+				return nil, fmt.Errorf("duplicate property %#x", id)
+			}
+			seen |= 1 << id
+		}
+
+		if err := pd.readProperty(p, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// readProperty reads the value of property id into p.
+func (d *decoder) readProperty(p *Properties, id int) error {
+	var err error
+
+	switch id {
+	case propPayloadFormat:
+		p.PayloadFormat, err = d.readFlag()
+	case propMessageExpiry:
+		p.MessageExpiry, err = ptr(d.readUint32())
+	case propContentType:
+		p.ContentType, err = d.readString()
+	case propResponseTopic:
+		p.ResponseTopic, err = d.readString()
+		if err == nil && p.ResponseTopic == "" {
+			err = errors.New("empty response topic")
+		}
+	case propCorrelationData:
+		p.CorrelationData, err = d.readBinary()
+	case propSubscriptionID:
+		var subID int
+		if subID, err = d.readVarInt(); err == nil && subID == 0 {
+			err = errors.New("invalid subscription identifier")
+		}
+		p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, uint32(subID))
+	case propSessionExpiry:
+		p.SessionExpiry, err = ptr(d.readUint32())
+	case propAssignedClientID:
+		p.AssignedClientID, err = d.readString()
+	case propServerKeepAlive:
+		p.ServerKeepAlive, err = ptr(d.readUint16())
+	case propAuthMethod:
+		p.AuthMethod, err = d.readString()
+	case propAuthData:
+		p.AuthData, err = d.readBinary()
+	case propRequestProblemInfo:
+		p.RequestProblemInfo, err = d.readBool()
+	case propWillDelay:
+		p.WillDelay, err = ptr(d.readUint32())
+	case propRequestResponseInfo:
+		p.RequestResponseInfo, err = d.readBool()
+	case propResponseInfo:
+		p.ResponseInfo, err = d.readString()
+	case propServerReference:
+		p.ServerReference, err = d.readString()
+	case propReasonString:
+		p.ReasonString, err = d.readString()
+	case propReceiveMaximum:
+		p.ReceiveMaximum, err = ptr(d.readNonZeroUint16())
+	case propTopicAliasMaximum:
+		p.TopicAliasMaximum, err = ptr(d.readUint16())
+	case propTopicAlias:
+		p.TopicAlias, err = ptr(d.readNonZeroUint16())
+	case propMaximumQoS:
+		var qos byte
+		qos, err = d.readFlag()
+		p.MaximumQoS = &qos
+	case propRetainAvailable:
+		p.RetainAvailable, err = d.readBool()
+	case propUserProperty:
+		var up UserProperty
+		if up.Key, err = d.readString(); err == nil {
+			up.Value, err = d.readString()
+		}
+		p.UserProperties = append(p.UserProperties, up)
+	case propMaximumPacketSize:
+		var size uint32
+		if size, err = d.readUint32(); err == nil && size == 0 {
+			err = errors.New("maximum packet size must not be 0")
+		}
+		p.MaximumPacketSize = &size
+	case propWildcardSubAvailable:
+		p.WildcardSubAvailable, err = d.readBool()
+	case propSubIDAvailable:
+		p.SubIDAvailable, err = d.readBool()
+	case propSharedSubAvailable:
+		p.SharedSubAvailable, err = d.readBool()
+	}
+
+	return err
+}
+
+// readFlag reads a byte property whose only valid values are 0 and 1.
+func (d *decoder) readFlag() (byte, error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	if b > 1 {
+		return 0, errors.New("invalid property value")
+	}
+
+	return b, nil
+}
+
+func (d *decoder) readBool() (*bool, error) {
+	b, err := d.readFlag()
+	if err != nil {
+		return nil, err
+	}
+
+	v := b == 1
+	return &v, nil
+}
+
+func (d *decoder) readUint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *decoder) readNonZeroUint16() (uint16, error) {
+	v, err := d.readUint16()
+	if err == nil && v == 0 {
+		err = errors.New("invalid property value")
+	}
+	return v, err
+}
+
+// ptr returns a pointer to v, for the optional properties.
+func ptr[T any](v T, err error) (*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// packetName returns the name of a packet type, for error messages.
+func packetName(t PacketType) string {
+	names := [...]string{
+		willProperties:        "will properties",
+		PacketTypeConnect:     "CONNECT",
+		PacketTypeConnAck:     "CONNACK",
+		PacketTypePublish:     "PUBLISH",
+		PacketTypePubAck:      "PUBACK",
+		PacketTypePubRec:      "PUBREC",
+		PacketTypePubRel:      "PUBREL",
+		PacketTypePubComp:     "PUBCOMP",
+		PacketTypeSubscribe:   "SUBSCRIBE",
+		PacketTypeSubAck:      "SUBACK",
+		PacketTypeUnsubscribe: "UNSUBSCRIBE",
+		PacketTypeUnsubAck:    "UNSUBACK",
+		PacketTypePingReq:     "PINGREQ",
+		PacketTypePingResp:    "PINGRESP",
+		PacketTypeDisconnect:  "DISCONNECT",
+		PacketTypeAuth:        "AUTH",
+	}
+	return names[t]
+}
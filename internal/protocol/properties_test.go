@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeConnectV5(t *testing.T) {
+	pkt, err := Decode(bytes.NewReader([]byte{
+		0x10, 0x1C,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x05,
+		0x42, // password, clean start
+		0x00, 0x3C,
+		0x08,                         // properties length
+		0x11, 0x00, 0x00, 0x0E, 0x10, // session expiry 3600
+		0x21, 0x00, 0x0A, // receive maximum 10
+		0x00, 0x01, 'c',
+		0x00, 0x04, 'p', 'a', 's', 's',
+	}))
+	require.NoError(t, err)
+
+	conn, ok := pkt.(*ConnectPacket)
+	require.True(t, ok, "expected ConnectPacket")
+	assert.Equal(t, Version5, conn.ProtocolLevel)
+	assert.Equal(t, "c", conn.ClientID)
+	assert.Nil(t, conn.Username)
+	require.NotNil(t, conn.Password, "MQTT 5 allows a password without a username")
+	assert.Equal(t, "pass", *conn.Password)
+
+	require.NotNil(t, conn.Properties)
+	require.NotNil(t, conn.Properties.SessionExpiry)
+	assert.Equal(t, uint32(3600), *conn.Properties.SessionExpiry)
+	require.NotNil(t, conn.Properties.ReceiveMaximum)
+	assert.Equal(t, uint16(10), *conn.Properties.ReceiveMaximum)
+}
+
+func TestDecodeUnsupportedProtocolLevel(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte{
+		0x10, 0x0D,
+		0x00, 0x04, 'M', 'Q', 'T', 'T',
+		0x06,
+		0x02,
+		0x00, 0x3C,
+		0x00, 0x01, 'c',
+	}))
+	assert.ErrorIs(t, err, ErrUnsupportedProtocolVersion)
+}
+
+func TestDecodeProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+	}{
+		{
+			name:  "PUBLISH with user property",
+			input: []byte{0x30, 0x0B, 0x00, 0x01, 'a', 0x07, 0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v'},
+		},
+		{
+			name:    "duplicate property",
+			input:   []byte{0x30, 0x08, 0x00, 0x01, 'a', 0x04, 0x01, 0x01, 0x01, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "property not allowed in PUBLISH",
+			input:   []byte{0x30, 0x07, 0x00, 0x01, 'a', 0x03, 0x21, 0x00, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "unknown property",
+			input:   []byte{0x30, 0x05, 0x00, 0x01, 'a', 0x01, 0x7F},
+			wantErr: true,
+		},
+		{
+			name:    "invalid payload format",
+			input:   []byte{0x30, 0x06, 0x00, 0x01, 'a', 0x02, 0x01, 0x02},
+			wantErr: true,
+		},
+		{
+			name:    "properties longer than the packet",
+			input:   []byte{0x30, 0x05, 0x00, 0x01, 'a', 0x05, 0x01},
+			wantErr: true,
+		},
+		{
+			name:  "empty topic with alias",
+			input: []byte{0x30, 0x06, 0x00, 0x00, 0x03, 0x23, 0x00, 0x01},
+		},
+		{
+			name:    "empty topic without alias",
+			input:   []byte{0x30, 0x03, 0x00, 0x00, 0x00},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeVersion(bytes.NewReader(tt.input), Version5)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDecodeAckV5(t *testing.T) {
+	pkt, err := DecodeVersion(bytes.NewReader([]byte{0x40, 0x02, 0x00, 0x07}), Version5)
+	require.NoError(t, err)
+	assert.Equal(t, &PubAckPacket{PacketID: 7}, pkt, "a missing reason code means success")
+
+	pkt, err = DecodeVersion(bytes.NewReader([]byte{0x40, 0x03, 0x00, 0x07, 0x10}), Version5)
+	require.NoError(t, err)
+	assert.Equal(t, &PubAckPacket{PacketID: 7, ReasonCode: ReasonNoMatchingSubscribers}, pkt)
+
+	_, err = Decode(bytes.NewReader([]byte{0x40, 0x03, 0x00, 0x07, 0x10}))
+	assert.Error(t, err, "MQTT 3.1.1 acknowledgements have no reason code")
+}
+
+func TestEncodeDropsProperties(t *testing.T) {
+	pub := &PublishPacket{
+		Topic:      "a",
+		Payload:    []byte("x"),
+		Properties: &Properties{ContentType: "text/plain"},
+	}
+
+	var v3, v5 bytes.Buffer
+	require.NoError(t, Encode(&v3, pub))
+	require.NoError(t, EncodeVersion(&v5, pub, Version5))
+
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 'a', 'x'}, v3.Bytes())
+	assert.Equal(t, []byte{
+		0x30, 0x12, 0x00, 0x01, 'a',
+		0x0D, 0x03, 0x00, 0x0A, 't', 'e', 'x', 't', '/', 'p', 'l', 'a', 'i', 'n',
+		'x',
+	}, v5.Bytes())
+
+	// Properties a packet type cannot carry are left out.
+	var buf bytes.Buffer
+	require.NoError(t, EncodeVersion(&buf, &PubAckPacket{PacketID: 1, Properties: pub.Properties}, Version5))
+	assert.Equal(t, []byte{0x40, 0x04, 0x00, 0x01, 0x00, 0x00}, buf.Bytes())
+}
@@ -0,0 +1,17 @@
+package protocol
+
+// PubAckPacket is a PUBACK packet sent in response to a QoS 1 PUBLISH packet.
+// The server sends it to acknowledge a client's PUBLISH, and the client sends
+// it to acknowledge a PUBLISH delivered by the server.
+//
+// It contains the packet identifier of the PUBLISH being acknowledged, and
+// for MQTT 5 a reason code and properties.
+type PubAckPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+func (p *PubAckPacket) Type() PacketType {
+	return PacketTypePubAck
+}
@@ -4,10 +4,22 @@ package protocol
 // and is used to send a message to all clients subscribed to topics that
 // match the packet's topic name.
 //
-// It contains the topic name and the message payload.
+// It contains the topic name and the message payload. QoS 1 and QoS 2
+// packets also carry a non-zero packet identifier, and Dup is set when the packet is a
+// retransmission of an earlier attempt. Retain asks the server to keep
+// the message for future subscribers, and is set on messages the server
+// delivers from its retained store. MQTT 5 packets carry the properties of
+// the message.
 type PublishPacket struct {
 	Topic   string
 	Payload []byte
+
+	QoS      byte
+	Dup      bool
+	Retain   bool
+	PacketID uint16
+
+	Properties *Properties
 }
 
 func (p *PublishPacket) Type() PacketType {
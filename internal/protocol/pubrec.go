@@ -0,0 +1,49 @@
+package protocol
+
+// PubRecPacket is a PUBREC packet, the first acknowledgement of a QoS 2
+// PUBLISH. The receiver of the PUBLISH sends it to confirm it has stored
+// the message.
+//
+// It contains the packet identifier of the PUBLISH being acknowledged, and
+// for MQTT 5 a reason code and properties.
+type PubRecPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+// PubRelPacket is a PUBREL packet sent in response to a PUBREC packet.
+// Once it is sent, the sender of the PUBLISH will not retransmit the
+// message itself, only the PUBREL.
+//
+// It contains the packet identifier of the PUBLISH being released, and
+// for MQTT 5 a reason code and properties.
+type PubRelPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+// PubCompPacket is a PUBCOMP packet sent in response to a PUBREL packet.
+// It is the last packet of the QoS 2 exchange, after which the packet
+// identifier can be reused.
+//
+// It contains the packet identifier of the PUBLISH being completed, and
+// for MQTT 5 a reason code and properties.
+type PubCompPacket struct {
+	PacketID   uint16
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+func (p *PubRecPacket) Type() PacketType {
+	return PacketTypePubRec
+}
+
+func (p *PubRelPacket) Type() PacketType {
+	return PacketTypePubRel
+}
+
+func (p *PubCompPacket) Type() PacketType {
+	return PacketTypePubComp
+}
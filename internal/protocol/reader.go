@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"unsafe"
+)
+
+const (
+	// readerBufferSize is the size of the buffer a Reader keeps in front of
+	// its connection.
+	readerBufferSize = 4096
+
+	// maxReusedBody is the largest packet body a Reader keeps around for the
+	// next packet. Larger bodies get a buffer of their own, so one big
+	// PUBLISH does not pin its memory for the lifetime of the connection.
+	maxReusedBody = maxEagerBody
+
+	// maxInternedTopics and maxInternedTopicLen bound the topic cache of a
+	// Reader.
+	maxInternedTopics   = 256
+	maxInternedTopicLen = 256
+)
+
+// Reader decodes consecutive packets from a stream, typically a network
+// connection. Unlike Decode, it keeps its read buffer across packets, so
+// bytes that arrive ahead of time when a client pipelines packets are not
+// lost and small packets are read with few system calls.
+//
+// The body of each packet is read into a buffer that is reused for the
+// next one; payloads are copied out of it, so decoded packets stay valid
+// after the next call to ReadPacket. Topic names are kept in a small cache
+// so clients publishing to the same topics do not allocate a new string
+// for every message.
+//
+// A Reader is not safe for concurrent use.
+type Reader struct {
+	r             *bufio.Reader
+	maxPacketSize int
+
+	body   []byte
+	dec    decoder
+	topics map[string]string
+}
+
+// NewReader returns a Reader that decodes packets from r.
+func NewReader(r io.Reader) *Reader {
+	pr := &Reader{
+		r:      bufio.NewReaderSize(r, readerBufferSize),
+		topics: make(map[string]string),
+	}
+	pr.dec.copyBytes = true
+	pr.dec.intern = pr.intern
+
+	return pr
+}
+
+// SetMaxPacketSize makes ReadPacket reject packets larger than n bytes,
+// fixed header included, with ErrPacketTooLarge. Zero or less only applies
+// the protocol limit.
+func (r *Reader) SetMaxPacketSize(n int) {
+	r.maxPacketSize = n
+}
+
+// SetVersion makes ReadPacket decode packets in the format of the given
+// protocol version, Version311 or Version5. A server sets it once the
+// CONNECT of the client has been read; until then, packets are decoded as
+// MQTT 3.1.1.
+func (r *Reader) SetVersion(version byte) {
+	r.dec.version = version
+}
+
+// ReadPacket reads and decodes the next packet.
+func (r *Reader) ReadPacket() (Packet, error) {
+	header, remainingLength, err := readFixedHeader(r.r, r.maxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if remainingLength > maxReusedBody {
+		body, err = readBody(r.r, remainingLength)
+	} else {
+		body = r.bodyBuffer(remainingLength)
+		_, err = io.ReadFull(r.r, body)
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	r.dec.buf, r.dec.pos = body, 0
+	p, err := decodePacket(header, &r.dec)
+	r.dec.buf = nil
+
+	return p, err
+}
+
+// bodyBuffer returns the reused buffer, holding n bytes, for a packet body
+// of at most maxReusedBody bytes.
+func (r *Reader) bodyBuffer(n int) []byte {
+	if cap(r.body) < n {
+		r.body = make([]byte, n, max(n, 256))
+	}
+
+	return r.body[:n]
+}
+
+// intern returns the topic name held in b as a string, reusing a previous
+// string with the same contents when there is one.
+func (r *Reader) intern(b []byte) string {
+	if len(b) > maxInternedTopicLen {
+		return string(b)
+	}
+
+	// The map lookup does not allocate for the conversion.
+	if s, ok := r.topics[string(b)]; ok {
+		return s
+	}
+
+	if len(r.topics) >= maxInternedTopics {
+		clear(r.topics)
+	}
+
+	s := string(b)
+	r.topics[s] = s
+	return s
+}
+
+// DecodeBytes decodes the packet at the start of b and returns it with the
+// number of bytes it took. If b does not hold a whole packet, it returns
+// io.ErrUnexpectedEOF and the caller can try again with more data.
+//
+// Decoding does not copy: the payload of a PUBLISH, its topic name and
+// other binary fields point into b, so b must not be modified while the
+// packet is in use.
+func DecodeBytes(b []byte) (Packet, int, error) {
+	return DecodeBytesVersion(b, Version311)
+}
+
+// DecodeBytesVersion works like DecodeBytes, but decodes the packet in the
+// format of the given protocol version, Version311 or Version5.
+func DecodeBytesVersion(b []byte, version byte) (Packet, int, error) {
+	if len(b) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	remainingLength, n, err := parseRemainingLength(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := 1 + n
+	end := start + remainingLength
+	if end > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	d := decoder{buf: b[start:end], version: version, intern: aliasString}
+	p, err := decodePacket(b[0], &d)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return p, end, nil
+}
+
+// aliasString returns a string sharing its memory with b.
+func aliasString(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
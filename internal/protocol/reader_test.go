@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipelined holds a PINGREQ, two QoS 0 PUBLISH packets to the same topic
+// and a DISCONNECT, written back to back as a client may send them.
+var pipelined = []byte{
+	0xC0, 0x00,
+	0x30, 0x07, 0x00, 0x03, 'a', '/', 'b', 'h', 'i',
+	0x30, 0x07, 0x00, 0x03, 'a', '/', 'b', 'y', 'o',
+	0xE0, 0x00,
+}
+
+func TestReaderPipelined(t *testing.T) {
+	r := NewReader(bytes.NewReader(pipelined))
+
+	pkt, err := r.ReadPacket()
+	require.NoError(t, err)
+	assert.IsType(t, &PingReqPacket{}, pkt)
+
+	pkt, err = r.ReadPacket()
+	require.NoError(t, err)
+	first := pkt.(*PublishPacket)
+
+	pkt, err = r.ReadPacket()
+	require.NoError(t, err)
+	second := pkt.(*PublishPacket)
+
+	assert.Equal(t, "a/b", first.Topic)
+	assert.Equal(t, []byte("hi"), first.Payload, "payloads outlive the next read")
+	assert.Equal(t, []byte("yo"), second.Payload)
+	assert.Same(t, unsafe.StringData(first.Topic), unsafe.StringData(second.Topic), "topics are interned")
+
+	pkt, err = r.ReadPacket()
+	require.NoError(t, err)
+	assert.IsType(t, &DisconnectPacket{}, pkt)
+
+	_, err = r.ReadPacket()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderMaxPacketSize(t *testing.T) {
+	r := NewReader(bytes.NewReader(pipelined[2:]))
+	r.SetMaxPacketSize(8)
+
+	_, err := r.ReadPacket()
+	assert.ErrorIs(t, err, ErrPacketTooLarge)
+}
+
+func TestDecodeBytes(t *testing.T) {
+	pkt, n, err := DecodeBytes(pipelined[2:])
+	require.NoError(t, err)
+	assert.Equal(t, 9, n)
+
+	pub := pkt.(*PublishPacket)
+	assert.Equal(t, "a/b", pub.Topic)
+	assert.Equal(t, &pipelined[9], &pub.Payload[0], "the payload aliases the input")
+	assert.Same(t, &pipelined[6], unsafe.StringData(pub.Topic), "the topic aliases the input")
+	assert.Equal(t, 1.0, testing.AllocsPerRun(100, func() {
+		_, _, _ = DecodeBytes(pipelined[2:])
+	}), "only the packet is allocated")
+
+	for i := range 9 {
+		_, _, err := DecodeBytes(pipelined[2 : 2+i])
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "%d bytes", i)
+	}
+}
@@ -0,0 +1,417 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomPacket returns a random, valid packet of the given type, for the
+// given protocol version.
+func randomPacket(r *rand.Rand, t PacketType, version byte) Packet {
+	str := func(maxLen int) string {
+		b := make([]byte, r.IntN(maxLen+1))
+		for i := range b {
+			b[i] = byte('a' + r.IntN(26))
+		}
+		return string(b)
+	}
+	bin := func(maxLen int) []byte {
+		b := make([]byte, r.IntN(maxLen+1))
+		for i := range b {
+			b[i] = byte(r.UintN(256))
+		}
+		return b
+	}
+	packetID := func() uint16 {
+		return uint16(1 + r.IntN(65535))
+	}
+
+	v5 := version == Version5
+
+	// props returns random properties that a packet of type t may carry,
+	// or nil for MQTT 3.1.1.
+	props := func(t PacketType) *Properties {
+		if !v5 || r.IntN(3) == 0 {
+			return nil
+		}
+
+		p := &Properties{}
+		set := func(id int) bool {
+			return allowed(id, t) && r.IntN(2) == 0
+		}
+		u16 := func() *uint16 {
+			v := uint16(1 + r.IntN(65535))
+			return &v
+		}
+		u32 := func() *uint32 {
+			v := r.Uint32()
+			return &v
+		}
+		flag := func() *bool {
+			v := r.IntN(2) == 0
+			return &v
+		}
+
+		if set(propPayloadFormat) {
+			p.PayloadFormat = 1
+		}
+		if set(propMessageExpiry) {
+			p.MessageExpiry = u32()
+		}
+		if set(propContentType) {
+			p.ContentType = "text/" + str(10)
+		}
+		if set(propResponseTopic) {
+			p.ResponseTopic = "r/" + str(10)
+		}
+		if set(propCorrelationData) {
+			p.CorrelationData = append([]byte{0}, bin(16)...)
+		}
+		if set(propSubscriptionID) {
+			n := 1
+			if t == PacketTypePublish {
+				n += r.IntN(3)
+			}
+			for range n {
+				p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, uint32(1+r.IntN(maxSubscriptionID)))
+			}
+		}
+		if set(propSessionExpiry) {
+			p.SessionExpiry = u32()
+		}
+		if set(propAssignedClientID) {
+			p.AssignedClientID = "id-" + str(10)
+		}
+		if set(propServerKeepAlive) {
+			p.ServerKeepAlive = u16()
+		}
+		if set(propAuthMethod) {
+			p.AuthMethod = "SCRAM-" + str(4)
+		}
+		if set(propAuthData) {
+			p.AuthData = append([]byte{0}, bin(16)...)
+		}
+		if set(propRequestProblemInfo) {
+			p.RequestProblemInfo = flag()
+		}
+		if set(propWillDelay) {
+			p.WillDelay = u32()
+		}
+		if set(propRequestResponseInfo) {
+			p.RequestResponseInfo = flag()
+		}
+		if set(propResponseInfo) {
+			p.ResponseInfo = "i/" + str(10)
+		}
+		if set(propServerReference) {
+			p.ServerReference = "host-" + str(10)
+		}
+		if set(propReasonString) {
+			p.ReasonString = "because " + str(20)
+		}
+		if set(propReceiveMaximum) {
+			p.ReceiveMaximum = u16()
+		}
+		if set(propTopicAliasMaximum) {
+			p.TopicAliasMaximum = u16()
+		}
+		if set(propTopicAlias) {
+			p.TopicAlias = u16()
+		}
+		if set(propMaximumQoS) {
+			qos := byte(r.IntN(2))
+			p.MaximumQoS = &qos
+		}
+		if set(propRetainAvailable) {
+			p.RetainAvailable = flag()
+		}
+		if set(propUserProperty) {
+			for range 1 + r.IntN(3) {
+				p.UserProperties = append(p.UserProperties, UserProperty{Key: str(8), Value: str(8)})
+			}
+		}
+		if set(propMaximumPacketSize) {
+			size := uint32(1 + r.IntN(1<<20))
+			p.MaximumPacketSize = &size
+		}
+		if set(propWildcardSubAvailable) {
+			p.WildcardSubAvailable = flag()
+		}
+		if set(propSubIDAvailable) {
+			p.SubIDAvailable = flag()
+		}
+		if set(propSharedSubAvailable) {
+			p.SharedSubAvailable = flag()
+		}
+
+		// Empty properties are not sent, and decode as nil.
+		if reflect.ValueOf(*p).IsZero() {
+			return nil
+		}
+		return p
+	}
+
+	// reason returns a random reason code out of codes for MQTT 5, and
+	// success for MQTT 3.1.1.
+	reason := func(codes ...ReasonCode) ReasonCode {
+		if !v5 {
+			return ReasonSuccess
+		}
+		return codes[r.IntN(len(codes))]
+	}
+
+	switch t {
+	case PacketTypeConnect:
+		pkt := &ConnectPacket{
+			ProtocolName:  "MQTT",
+			ProtocolLevel: version,
+			CleanSession:  r.IntN(2) == 0,
+			KeepAlive:     uint16(r.UintN(65536)),
+			ClientID:      "c" + str(22),
+			Properties:    props(PacketTypeConnect),
+		}
+		if r.IntN(2) == 0 {
+			pkt.WillFlag = true
+			pkt.WillTopic = "w/" + str(30)
+			pkt.WillMessage = bin(300)
+			pkt.WillQoS = byte(r.IntN(3))
+			pkt.WillRetain = r.IntN(2) == 0
+			pkt.WillProperties = props(willProperties)
+		}
+		if r.IntN(2) == 0 {
+			username := str(10)
+			pkt.Username = &username
+		}
+		if (pkt.Username != nil || v5) && r.IntN(2) == 0 {
+			password := str(10)
+			pkt.Password = &password
+		}
+		return pkt
+
+	case PacketTypeConnAck:
+		pkt := &ConnAckPacket{
+			ReturnCode: ConnAckReturnCode(r.IntN(6)),
+			Properties: props(PacketTypeConnAck),
+		}
+		if v5 {
+			pkt.ReturnCode = reason(ReasonSuccess, ReasonUnsupportedProtocolVersion, ReasonBadUserNameOrPassword, ReasonServerBusy)
+		}
+		pkt.SessionPresent = pkt.ReturnCode == ConnAckAccepted && r.IntN(2) == 0
+		return pkt
+
+	case PacketTypePublish:
+		pkt := &PublishPacket{
+			Topic:   "t/" + str(40),
+			Payload: bin(1000),
+			QoS:     byte(r.IntN(3)),
+			Retain:  r.IntN(2) == 0,
+
+			Properties: props(PacketTypePublish),
+		}
+		if pkt.QoS > 0 {
+			pkt.PacketID = packetID()
+			pkt.Dup = r.IntN(2) == 0
+		}
+		return pkt
+
+	case PacketTypePubAck:
+		return &PubAckPacket{
+			PacketID:   packetID(),
+			ReasonCode: reason(ReasonSuccess, ReasonNoMatchingSubscribers, ReasonQuotaExceeded),
+			Properties: props(PacketTypePubAck),
+		}
+	case PacketTypePubRec:
+		return &PubRecPacket{
+			PacketID:   packetID(),
+			ReasonCode: reason(ReasonSuccess, ReasonNoMatchingSubscribers, ReasonPacketIdentifierInUse),
+			Properties: props(PacketTypePubRec),
+		}
+	case PacketTypePubRel:
+		return &PubRelPacket{
+			PacketID:   packetID(),
+			ReasonCode: reason(ReasonSuccess, ReasonPacketIdentifierNotFound),
+			Properties: props(PacketTypePubRel),
+		}
+	case PacketTypePubComp:
+		return &PubCompPacket{
+			PacketID:   packetID(),
+			ReasonCode: reason(ReasonSuccess, ReasonPacketIdentifierNotFound),
+			Properties: props(PacketTypePubComp),
+		}
+
+	case PacketTypeSubscribe:
+		pkt := &SubscribePacket{PacketID: packetID(), Properties: props(PacketTypeSubscribe)}
+		for range 1 + r.IntN(5) {
+			sub := Subscription{
+				Topic: str(20) + "/#",
+				QoS:   byte(r.IntN(3)),
+			}
+			if v5 {
+				sub.NoLocal = r.IntN(2) == 0
+				sub.RetainAsPublished = r.IntN(2) == 0
+				sub.RetainHandling = byte(r.IntN(3))
+			}
+			pkt.Subscriptions = append(pkt.Subscriptions, sub)
+		}
+		return pkt
+
+	case PacketTypeSubAck:
+		pkt := &SubAckPacket{PacketID: packetID(), Properties: props(PacketTypeSubAck)}
+		for range 1 + r.IntN(5) {
+			code := []byte{0x00, 0x01, 0x02, 0x80}[r.IntN(4)]
+			if v5 {
+				code = byte(reason(ReasonGrantedQoS0, ReasonGrantedQoS2, ReasonNotAuthorized, ReasonTopicFilterInvalid))
+			}
+			pkt.ReturnCodes = append(pkt.ReturnCodes, code)
+		}
+		return pkt
+
+	case PacketTypeUnsubscribe:
+		pkt := &UnsubscribePacket{PacketID: packetID(), Properties: props(PacketTypeUnsubscribe)}
+		for range 1 + r.IntN(5) {
+			pkt.Topics = append(pkt.Topics, str(20)+"/+")
+		}
+		return pkt
+
+	case PacketTypeUnsubAck:
+		pkt := &UnsubAckPacket{PacketID: packetID(), Properties: props(PacketTypeUnsubAck)}
+		if v5 {
+			for range 1 + r.IntN(5) {
+				pkt.ReasonCodes = append(pkt.ReasonCodes, reason(ReasonSuccess, ReasonNoSubscriptionExisted))
+			}
+		}
+		return pkt
+	case PacketTypePingReq:
+		return &PingReqPacket{}
+	case PacketTypePingResp:
+		return &PingRespPacket{}
+	case PacketTypeDisconnect:
+		return &DisconnectPacket{
+			ReasonCode: reason(ReasonNormalDisconnection, ReasonDisconnectWithWillMessage, ReasonServerShuttingDown),
+			Properties: props(PacketTypeDisconnect),
+		}
+	case PacketTypeAuth:
+		return &AuthPacket{
+			ReasonCode: reason(ReasonSuccess, ReasonContinueAuthentication, ReasonReAuthenticate),
+			Properties: props(PacketTypeAuth),
+		}
+	}
+
+	panic("unknown packet type")
+}
+
+// lastPacketType returns the last packet type of a protocol version.
+func lastPacketType(version byte) PacketType {
+	if version == Version5 {
+		return PacketTypeAuth
+	}
+	return PacketTypeDisconnect
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		t.Run(fmt.Sprintf("level %d", version), func(t *testing.T) {
+			r := rand.New(rand.NewPCG(1, uint64(version)))
+
+			for typ := PacketTypeConnect; typ <= lastPacketType(version); typ++ {
+				for range 200 {
+					want := randomPacket(r, typ, version)
+
+					var buf bytes.Buffer
+					require.NoError(t, EncodeVersion(&buf, want, version))
+					frame := bytes.Clone(buf.Bytes())
+
+					got, err := DecodeVersion(&buf, version)
+					require.NoError(t, err, "%#v", want)
+					require.Equal(t, want, got)
+					assert.Zero(t, buf.Len(), "the whole frame is consumed")
+
+					got, n, err := DecodeBytesVersion(frame, version)
+					require.NoError(t, err)
+					require.Equal(t, want, got)
+					assert.Equal(t, len(frame), n)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripStream(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		t.Run(fmt.Sprintf("level %d", version), func(t *testing.T) {
+			r := rand.New(rand.NewPCG(3, uint64(version)))
+
+			var (
+				stream bytes.Buffer
+				want   []Packet
+			)
+			for range 2000 {
+				p := randomPacket(r, PacketType(1+r.IntN(int(lastPacketType(version)))), version)
+				require.NoError(t, EncodeVersion(&stream, p, version))
+				want = append(want, p)
+			}
+
+			reader := NewReader(&stream)
+			reader.SetVersion(version)
+			for i, p := range want {
+				got, err := reader.ReadPacket()
+				require.NoError(t, err, "packet %d", i)
+
+				// Copied byte slices may be nil where the originals are
+				// empty, so the packets are compared in their encoded form.
+				var a, b bytes.Buffer
+				require.NoError(t, EncodeVersion(&a, p, version))
+				require.NoError(t, EncodeVersion(&b, got, version))
+				require.Equal(t, a.Bytes(), b.Bytes(), "packet %d", i)
+			}
+		})
+	}
+}
+
+func TestDecodeServerPackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		wantErr bool
+	}{
+		{name: "CONNACK", input: []byte{0x20, 0x02, 0x01, 0x00}},
+		{name: "CONNACK reserved flags", input: []byte{0x20, 0x02, 0x02, 0x00}, wantErr: true},
+		{name: "CONNACK session present on refusal", input: []byte{0x20, 0x02, 0x01, 0x05}, wantErr: true},
+		{name: "SUBACK", input: []byte{0x90, 0x04, 0x00, 0x01, 0x01, 0x80}},
+		{name: "SUBACK without return codes", input: []byte{0x90, 0x02, 0x00, 0x01}, wantErr: true},
+		{name: "SUBACK invalid return code", input: []byte{0x90, 0x03, 0x00, 0x01, 0x03}, wantErr: true},
+		{name: "UNSUBACK", input: []byte{0xB0, 0x02, 0x00, 0x07}},
+		{name: "UNSUBACK flags", input: []byte{0xB2, 0x02, 0x00, 0x07}, wantErr: true},
+		{name: "PINGRESP", input: []byte{0xD0, 0x00}},
+		{name: "PINGRESP with body", input: []byte{0xD0, 0x01, 0x00}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(bytes.NewReader(tt.input))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEncodeFieldTooLong(t *testing.T) {
+	long := string(make([]byte, 65536))
+
+	var buf bytes.Buffer
+	assert.ErrorIs(t, Encode(&buf, &SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []Subscription{{Topic: long}},
+	}), ErrFieldTooLong)
+	assert.ErrorIs(t, Encode(&buf, &PublishPacket{Topic: long}), ErrFieldTooLong)
+	assert.Zero(t, buf.Len(), "nothing is written")
+}
@@ -6,10 +6,12 @@ package protocol
 // It contains a packet identifier and a slice of return codes, one
 // for each topic in the SUBSCRIBE packet. The return codes are
 // byte values that indicate the success or failure of each topic
-// subscription.
+// subscription. MQTT 5 uses reason codes with the same values, and adds
+// properties.
 type SubAckPacket struct {
 	PacketID    uint16
 	ReturnCodes []byte
+	Properties  *Properties
 }
 
 func (s *SubAckPacket) Type() PacketType {
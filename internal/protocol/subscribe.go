@@ -6,11 +6,24 @@ package protocol
 type SubscribePacket struct {
 	PacketID      uint16
 	Subscriptions []Subscription
+	Properties    *Properties
 }
 
+// Subscription is a topic filter with its subscription options. Only the
+// QoS exists in MQTT 3.1.1.
 type Subscription struct {
 	Topic string
 	QoS   byte
+
+	// NoLocal asks the server not to send the client its own messages.
+	NoLocal bool
+
+	// RetainAsPublished keeps the retain flag of forwarded messages.
+	RetainAsPublished bool
+
+	// RetainHandling tells the server when to send retained messages: 0 on
+	// every subscribe, 1 only when the subscription is new, 2 never.
+	RetainHandling byte
 }
 
 func (s *SubscribePacket) Type() PacketType {
@@ -0,0 +1,29 @@
+package protocol
+
+// UnsubscribePacket represents an UNSUBSCRIBE packet sent by a client to the
+// server. It contains a packet identifier and the topic filters the client
+// wants to stop receiving messages for.
+type UnsubscribePacket struct {
+	PacketID   uint16
+	Topics     []string
+	Properties *Properties
+}
+
+// UnsubAckPacket is an UNSUBACK packet sent from the server to the client
+// in response to an UNSUBSCRIBE packet from the client.
+//
+// It contains the packet identifier of the UNSUBSCRIBE being acknowledged.
+// MQTT 5 adds one reason code per topic filter, and properties.
+type UnsubAckPacket struct {
+	PacketID    uint16
+	ReasonCodes []ReasonCode
+	Properties  *Properties
+}
+
+func (u *UnsubscribePacket) Type() PacketType {
+	return PacketTypeUnsubscribe
+}
+
+func (u *UnsubAckPacket) Type() PacketType {
+	return PacketTypeUnsubAck
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+)
+
+// topicAliases maps the topic aliases an MQTT 5 client defined on its
+// connection to their topic names.
+type topicAliases map[uint16]string
+
+// resolve handles the topic alias of a PUBLISH from the client. A PUBLISH
+// with a topic name and an alias (re)defines the alias, one with only an
+// alias gets the topic name it stands for. The alias is removed from the
+// packet, since it has no meaning beyond the connection.
+//
+// It returns the reason code to disconnect the client with when the alias
+// is out of range or was never defined, and ReasonSuccess otherwise.
+func (a topicAliases) resolve(p *protocol.PublishPacket, max uint16) protocol.ReasonCode {
+	if p.Properties == nil || p.Properties.TopicAlias == nil {
+		return protocol.ReasonSuccess
+	}
+
+	alias := *p.Properties.TopicAlias
+	if alias == 0 || alias > max {
+		return protocol.ReasonTopicAliasInvalid
+	}
+
+	if p.Topic != "" {
+		a[alias] = p.Topic
+	} else {
+		topic, ok := a[alias]
+		if !ok {
+			return protocol.ReasonProtocolError
+		}
+		p.Topic = topic
+	}
+
+	p.Properties.TopicAlias = nil
+	return protocol.ReasonSuccess
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+)
+
+var (
+	// ErrBadCredentials is returned by an Authenticator when the username or
+	// password is wrong. The client is refused with return code 0x04,
+	// or reason code 0x86 for MQTT 5 clients.
+	ErrBadCredentials = errors.New("bad username or password")
+
+	// ErrNotAuthorized is returned by an Authenticator when the client is
+	// not allowed to connect. The client is refused with return code 0x05,
+	// or reason code 0x87 for MQTT 5 clients.
+	ErrNotAuthorized = errors.New("not authorized")
+
+	// errUnsupportedAuthMethod refuses MQTT 5 clients asking for extended
+	// authentication, which the server does not support.
+	errUnsupportedAuthMethod = errors.New("unsupported authentication method")
+)
+
+// Authenticator decides whether a client may connect, based on the
+// credentials and other fields of its CONNECT packet.
+//
+// Authenticate returns nil to accept the client. Any other error refuses
+// the connection: ErrBadCredentials is reported to the client as a bad
+// username or password, every other error as not authorized.
+type Authenticator interface {
+	Authenticate(connect *protocol.ConnectPacket) error
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator
+// interface.
+type AuthenticatorFunc func(connect *protocol.ConnectPacket) error
+
+func (f AuthenticatorFunc) Authenticate(connect *protocol.ConnectPacket) error {
+	return f(connect)
+}
+
+// authReturnCode maps the result of an Authenticator to the CONNACK return
+// code sent to a client of the given protocol version. MQTT 5 clients get
+// the matching reason code.
+func authReturnCode(err error, version byte) protocol.ConnAckReturnCode {
+	v5 := version == protocol.Version5
+
+	switch {
+	case err == nil:
+		return protocol.ConnAckAccepted
+	case errors.Is(err, ErrBadCredentials) && v5:
+		return protocol.ReasonBadUserNameOrPassword
+	case errors.Is(err, ErrBadCredentials):
+		return protocol.ConnAckBadUsernameOrPassword
+	case errors.Is(err, errUnsupportedAuthMethod) && v5:
+		return protocol.ReasonBadAuthenticationMethod
+	case v5:
+		return protocol.ReasonNotAuthorized
+	default:
+		return protocol.ConnAckNotAuthorized
+	}
+}
@@ -1,36 +1,316 @@
 package server
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/lucasmendoncca/OrbMQ/internal/broker"
 	"github.com/lucasmendoncca/OrbMQ/internal/client"
 	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
 )
 
 type Server struct {
 	addr   string
 	broker *broker.Broker
+	auth   Authenticator
+
+	// clientIDPrefix starts every identifier the server assigns to clients
+	// that connect with an empty ClientID.
+	clientIDPrefix string
+
+	// maxKeepAlive caps the keep-alive requested by clients, and
+	// keepAliveOverride replaces it altogether. Zero disables either.
+	maxKeepAlive      time.Duration
+	keepAliveOverride time.Duration
+
+	// topicAliasMaximum is the number of topic aliases MQTT 5 clients may
+	// use in the messages they publish.
+	topicAliasMaximum uint16
+
+	// receiveMaximum is the number of QoS 2 messages an MQTT 5 client may
+	// publish without having released them.
+	receiveMaximum uint16
+
+	// maxSessionExpiry caps the time sessions outlive their connection.
+	// Zero disables the cap.
+	maxSessionExpiry time.Duration
+
+	// maxPacketSize is the largest packet accepted from clients, in bytes.
+	// Listeners may override it. Zero only applies the protocol limit of
+	// 256 MB.
+	maxPacketSize int
+
+	// listeners are accepted on in addition to addr.
+	listeners []Listener
+
+	// conns holds the live connection of every client identifier, so a new
+	// connection with the same identifier can take over from the old one.
+	connsMu sync.Mutex
+	conns   map[string]*liveConn
+
+	// wills holds the wills waiting for their Will Delay Interval, by
+	// client identifier. It is guarded by connsMu.
+	wills map[string]*delayedWill
+}
+
+// liveConn is a network connection registered under its client identifier.
+// done is closed once the connection has been torn down, including the
+// publication, or delay, of its will.
+type liveConn struct {
+	conn     net.Conn
+	assigned bool
+	done     chan struct{}
+}
+
+// Listener is an additional TCP address the server accepts connections on.
+type Listener struct {
+	Addr string
+
+	// MaxPacketSize overrides the server-wide maximum packet size for
+	// connections accepted on this listener. Zero keeps the server-wide one.
+	MaxPacketSize int
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ClientID   string
+	RemoteAddr string
+
+	// AssignedID reports whether ClientID was generated by the server
+	// because the client connected with an empty one.
+	AssignedID bool
+}
+
+// DefaultClientIDPrefix is the prefix of server-assigned client identifiers
+// unless WithClientIDPrefix is used.
+const DefaultClientIDPrefix = "orbmq-"
+
+// ReservedClientIDPrefix starts the identifiers of subscribers living in the
+// same process as the broker. Network clients using it are refused, so they
+// cannot take the place of such a subscriber in the topic tree.
+const ReservedClientIDPrefix = "$orbmq/"
+
+// DefaultTopicAliasMaximum is the number of topic aliases MQTT 5 clients may
+// use per connection unless WithTopicAliasMaximum is used.
+const DefaultTopicAliasMaximum = 64
+
+// DefaultReceiveMaximum is the number of unreleased QoS 2 messages an
+// MQTT 5 client may publish unless WithReceiveMaximum is used.
+const DefaultReceiveMaximum = 1024
+
+// connectTimeout bounds the time a new connection may take to send its
+// CONNECT packet.
+const connectTimeout = 10 * time.Second
+
+// Option configures optional behavior of a Server.
+type Option func(*Server)
+
+// WithAuthenticator makes the server check every CONNECT with the given
+// Authenticator before accepting the client. Without it, every client is
+// accepted.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithClientIDPrefix sets the prefix of the identifiers the server assigns
+// to clients that connect with an empty ClientID.
+func WithClientIDPrefix(prefix string) Option {
+	return func(s *Server) {
+		s.clientIDPrefix = prefix
+	}
+}
+
+// WithMaxKeepAlive caps the keep-alive interval of clients. Clients asking
+// for a longer interval, or MQTT 5 clients asking for none at all, are held
+// to max instead.
+func WithMaxKeepAlive(max time.Duration) Option {
+	return func(s *Server) {
+		s.maxKeepAlive = max
+	}
+}
+
+// WithKeepAliveOverride enforces the given keep-alive interval on every
+// client, regardless of the one it asked for. MQTT 3.1.1 clients are not
+// told about it, so it should not be shorter than the interval they use,
+// and it does not apply to those that disabled keep-alive.
+func WithKeepAliveOverride(keepAlive time.Duration) Option {
+	return func(s *Server) {
+		s.keepAliveOverride = keepAlive
+	}
+}
+
+// WithTopicAliasMaximum sets the number of topic aliases an MQTT 5 client
+// may define on a connection for the messages it publishes. Zero disables
+// inbound topic aliases.
+func WithTopicAliasMaximum(max uint16) Option {
+	return func(s *Server) {
+		s.topicAliasMaximum = max
+	}
+}
+
+// WithReceiveMaximum sets the number of QoS 2 messages an MQTT 5 client
+// may publish before it has released them with a PUBREL. QoS 1 messages
+// are acknowledged as they arrive, so they never count. Zero is not a
+// valid limit and keeps the default.
+func WithReceiveMaximum(max uint16) Option {
+	return func(s *Server) {
+		if max > 0 {
+			s.receiveMaximum = max
+		}
+	}
+}
+
+// WithMaxSessionExpiry caps the time a session is kept after its connection
+// ends: the session expiry interval of MQTT 5 clients, and the lifetime of
+// persistent MQTT 3.1.1 sessions, which otherwise never expire.
+func WithMaxSessionExpiry(max time.Duration) Option {
+	return func(s *Server) {
+		s.maxSessionExpiry = max
+	}
 }
 
-func New(addr string, b *broker.Broker) *Server {
-	return &Server{
-		addr:   addr,
-		broker: b,
+// WithMaxPacketSize limits the size of packets accepted from clients,
+// fixed header included. Clients sending a larger packet are disconnected
+// before the packet is read into memory. Zero, the default, only applies
+// the protocol limit of 256 MB; packets that large are still only given
+// memory as their bytes arrive.
+func WithMaxPacketSize(size int) Option {
+	return func(s *Server) {
+		s.maxPacketSize = size
 	}
 }
 
+// WithListener makes the server accept connections on an additional
+// address, with its own packet size limit.
+func WithListener(l Listener) Option {
+	return func(s *Server) {
+		s.listeners = append(s.listeners, l)
+	}
+}
+
+func New(addr string, b *broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		addr:              addr,
+		broker:            b,
+		clientIDPrefix:    DefaultClientIDPrefix,
+		topicAliasMaximum: DefaultTopicAliasMaximum,
+		receiveMaximum:    DefaultReceiveMaximum,
+		conns:             make(map[string]*liveConn),
+		wills:             make(map[string]*delayedWill),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Start listens on the server address and on every additional listener,
+// and serves connections until ctx is done. It returns the first error
+// that stopped a listener.
 func (s *Server) Start(ctx context.Context) error {
-	ln, err := net.Listen("tcp", s.addr)
-	if err != nil {
-		return err
+	listeners := append([]Listener{{Addr: s.addr}}, s.listeners...)
+
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+
+	// Closing the listeners unblocks Accept once ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+
+	errs := make(chan error, len(lns))
+	for i, ln := range lns {
+		maxPacketSize := s.maxPacketSize
+		if listeners[i].MaxPacketSize > 0 {
+			maxPacketSize = listeners[i].MaxPacketSize
+		}
+
+		go func() {
+			errs <- s.serve(ctx, ln, maxPacketSize)
+		}()
+	}
+
+	var err error
+	for range lns {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
 	}
-	defer ln.Close()
 
-	log.Printf("Listening on %s", s.addr)
+	return err
+}
+
+// Serve accepts connections on ln until ctx is done, with the server-wide
+// maximum packet size. It lets the caller provide the listener, for
+// example one bound to a port picked by the system, and closes it when
+// ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	return s.ServeLimit(ctx, ln, 0)
+}
+
+// ServeLimit works like Serve, but connections accepted on ln are limited to
+// packets of at most maxPacketSize bytes. Zero keeps the server-wide limit,
+// like Listener.MaxPacketSize.
+func (s *Server) ServeLimit(ctx context.Context, ln net.Listener, maxPacketSize int) error {
+	if maxPacketSize <= 0 {
+		maxPacketSize = s.maxPacketSize
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		ln.Close()
+	}()
+
+	return s.serve(ctx, ln, maxPacketSize)
+}
+
+// serve accepts connections on ln until ctx is done or the listener fails.
+// Connections are limited to packets of at most maxPacketSize bytes.
+//
+// Connections are closed once ctx is done, and serve only returns after
+// all of them have been torn down.
+func (s *Server) serve(ctx context.Context, ln net.Listener, maxPacketSize int) error {
+	log.Printf("Listening on %s", ln.Addr())
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
 
 	for {
 		conn, err := ln.Accept()
@@ -39,19 +319,50 @@ func (s *Server) Start(ctx context.Context) error {
 			case <-ctx.Done():
 				return nil
 			default:
-				log.Printf("accept error: %v", err)
-				continue
 			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			log.Printf("accept error: %v", err)
+			continue
 		}
 
-		go s.handleConn(ctx, conn)
+		conns.Go(func() {
+			s.handleConn(ctx, conn, maxPacketSize)
+		})
 	}
 }
 
-func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+func (s *Server) handleConn(ctx context.Context, conn net.Conn, maxPacketSize int) {
+	defer conn.Close()
+
+	// Closing the connection interrupts any read once the server stops.
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// The reader lives as long as the connection, so packets pipelined by
+	// the client behind the CONNECT are kept in its buffer.
+	r := protocol.NewReader(conn)
+	r.SetMaxPacketSize(maxPacketSize)
 
 	// --- 1. CONNECT ---
-	pkt, err := protocol.Decode(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	pkt, err := r.ReadPacket()
+	if errors.Is(err, protocol.ErrUnsupportedProtocolVersion) {
+		log.Printf("decode error (CONNECT): %v", err)
+		// The client speaks a version the server does not know, so it is
+		// answered in the MQTT 3.1.1 format.
+		if err := protocol.Encode(conn, &protocol.ConnAckPacket{
+			ReturnCode: protocol.ConnAckUnacceptableProtocolVersion,
+		}); err != nil {
+			log.Printf("connack error: %v", err)
+		}
+		return
+	}
 	if err != nil {
 		log.Printf("decode error (CONNECT): %v", err)
 		return
@@ -63,31 +374,143 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 		return
 	}
 
-	cli := client.New(connect.ClientID, conn)
-	defer func() {
-		s.broker.UnsubscribeAll(cli.ID())
-		cli.Close()
-	}()
+	// Every later packet of the connection, in either direction, uses the
+	// protocol version of the CONNECT.
+	version := connect.ProtocolLevel
+	r.SetVersion(version)
+
+	// An empty ClientID is only accepted with a clean session. Such clients
+	// get a unique identifier, so they do not share one session.
+	assigned := connect.ClientID == ""
+	if assigned {
+		connect.ClientID = s.assignClientID()
+		log.Printf("assigned client identifier %s", connect.ClientID)
+	}
+
+	if strings.HasPrefix(connect.ClientID, ReservedClientIDPrefix) {
+		log.Printf("client %s refused: reserved client identifier", connect.ClientID)
+		returnCode := protocol.ConnAckIdentifierRejected
+		if version == protocol.Version5 {
+			returnCode = protocol.ReasonClientIdentifierNotValid
+		}
+		if err := protocol.EncodeVersion(conn, &protocol.ConnAckPacket{ReturnCode: returnCode}, version); err != nil {
+			log.Printf("connack error: %v", err)
+		}
+		return
+	}
 
-	log.Printf("client connected: %s", cli.ID())
+	// --- 2. AUTHENTICATION ---
+	var authErr error
+	switch {
+	case connect.Properties != nil && connect.Properties.AuthMethod != "":
+		// Extended authentication is not supported.
+		authErr = errUnsupportedAuthMethod
+	case s.auth != nil:
+		authErr = s.auth.Authenticate(connect)
+	}
 
-	// --- 2. CONNACK ---
-	err = protocol.Encode(conn, &protocol.ConnAckPacket{
-		SessionPresent: false,
+	if authErr != nil {
+		log.Printf("client %s refused: %v", connect.ClientID, authErr)
+		if err := protocol.EncodeVersion(conn, &protocol.ConnAckPacket{
+			ReturnCode: authReturnCode(authErr, version),
+		}, version); err != nil {
+			log.Printf("connack error: %v", err)
+		}
+		return
+	}
+
+	// --- 3. SESSION ---
+	// Any connection already using the client identifier is closed, and has
+	// released the session and published or delayed its will, before the
+	// session is opened for this one.
+	lc := s.takeOver(connect.ClientID, conn, assigned)
+	defer s.release(connect.ClientID, lc)
+
+	// A will still delayed from an earlier connection is not published,
+	// since the session lives on, unless the session starts over.
+	s.cancelWill(connect.ClientID, connect.CleanSession)
+
+	requestedExpiry := sessionExpiry(connect)
+	grantedExpiry := s.capSessionExpiry(requestedExpiry)
+	cli, sessionPresent := s.broker.OpenSession(connect.ClientID, connect.CleanSession, grantedExpiry)
+
+	keepAlive := s.keepAlive(connect.KeepAlive, version)
+
+	// --- 4. CONNACK ---
+	// Written before the client is attached, so it always precedes any
+	// retransmitted messages on the wire.
+	connack := &protocol.ConnAckPacket{
+		SessionPresent: sessionPresent,
 		ReturnCode:     protocol.ConnAckAccepted,
-	})
-	if err != nil {
+	}
+	if version == protocol.Version5 {
+		connack.Properties = s.connAckProperties(connect, assigned, keepAlive, maxPacketSize)
+	}
+
+	if err := protocol.EncodeVersion(conn, connack, version); err != nil {
 		log.Printf("connack error: %v", err)
+		s.broker.CloseSession(cli)
 		return
 	}
 
-	// --- 3. LOOP AFTER HANDSHAKE ---
+	cli.Attach(conn, connParams(connect))
+
+	// Topic aliases defined by the client for its own messages.
+	aliases := make(topicAliases)
+
+	// The will is kept for as long as the connection lives and is published
+	// unless the client says goodbye with a DISCONNECT, after the Will Delay
+	// Interval of MQTT 5 clients.
+	will := willMessage(connect, cli.ID())
+	defer func() {
+		cli.Detach(conn)
+		s.broker.CloseSession(cli)
+
+		if will != nil {
+			s.publishWill(cli.ID(), *will, connect.WillProperties, grantedExpiry)
+		}
+	}()
+
+	log.Printf("client connected: %s (protocol level %d, session present: %t, keep-alive: %s)", cli.ID(), version, sessionPresent, keepAlive)
+
+	// disconnect closes the connection after telling an MQTT 5 client the
+	// reason. MQTT 3.1.1 has no way to do so.
+	disconnect := func(code protocol.ReasonCode) {
+		if version == protocol.Version5 {
+			cli.Disconnect(conn, &protocol.DisconnectPacket{ReasonCode: code})
+		}
+	}
+
+	// --- 5. LOOP AFTER HANDSHAKE ---
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			pkt, err := protocol.Decode(conn)
+			// A client that stays silent for one and a half keep-alive
+			// intervals is considered gone.
+			var deadline time.Time
+			if keepAlive > 0 {
+				deadline = time.Now().Add(keepAlive * 3 / 2)
+			}
+			_ = conn.SetReadDeadline(deadline)
+
+			pkt, err := r.ReadPacket()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("client %s keep-alive expired", cli.ID())
+				disconnect(protocol.ReasonKeepAliveTimeout)
+				return
+			}
+			if errors.Is(err, protocol.ErrPacketTooLarge) {
+				log.Printf("client %s sent a packet over the size limit", cli.ID())
+				disconnect(protocol.ReasonPacketTooLarge)
+				return
+			}
+			if errors.Is(err, protocol.ErrInvalidTopicName) {
+				log.Printf("client %s published to a wildcard topic", cli.ID())
+				disconnect(protocol.ReasonTopicNameInvalid)
+				return
+			}
 			if err != nil {
 				log.Printf("decode error: %v", err)
 				return
@@ -96,23 +519,46 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 			switch p := pkt.(type) {
 
 			case *protocol.PingReqPacket:
-				if err := protocol.Encode(conn, &protocol.PingRespPacket{}); err != nil {
+				if err := cli.Send(&protocol.PingRespPacket{}); err != nil {
 					log.Printf("pingresp error: %v", err)
 					return
 				}
 
 			case *protocol.SubscribePacket:
-				for _, sub := range p.Subscriptions {
-					s.broker.Subscribe(sub.Topic, cli)
-				}
-
 				// SUBACK
 				returnCodes := make([]byte, len(p.Subscriptions))
-				for i := range returnCodes {
-					returnCodes[i] = 0x00 // QoS 0
+
+				// MQTT 5 clients may give the subscriptions an identifier,
+				// sent back with the messages they match.
+				var subID uint32
+				if p.Properties != nil && len(p.Properties.SubscriptionIdentifiers) > 0 {
+					subID = p.Properties.SubscriptionIdentifiers[0]
+				}
+
+				for i, sub := range p.Subscriptions {
+					group, filter, err := topic.ParseShared(sub.Topic)
+					if err != nil || !topic.ValidFilter(filter) {
+						returnCodes[i] = subscribeFailure(version)
+						continue
+					}
+					if group != "" && sub.NoLocal {
+						log.Printf("client %s set No Local on a shared subscription", cli.ID())
+						disconnect(protocol.ReasonProtocolError)
+						return
+					}
+
+					returnCodes[i] = sub.QoS
+					s.broker.SubscribeWith(sub.Topic, topic.Subscription{
+						Subscriber:        cli,
+						QoS:               returnCodes[i],
+						NoLocal:           sub.NoLocal,
+						RetainAsPublished: sub.RetainAsPublished,
+						RetainHandling:    sub.RetainHandling,
+						Identifier:        subID,
+					})
 				}
 
-				if err := protocol.Encode(conn, &protocol.SubAckPacket{
+				if err := cli.Send(&protocol.SubAckPacket{
 					PacketID:    p.PacketID,
 					ReturnCodes: returnCodes,
 				}); err != nil {
@@ -120,17 +566,117 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 					return
 				}
 
+			case *protocol.UnsubscribePacket:
+				// MQTT 5 clients learn whether each subscription existed.
+				ack := &protocol.UnsubAckPacket{PacketID: p.PacketID}
+				for _, filter := range p.Topics {
+					code := protocol.ReasonSuccess
+					if _, f, err := topic.ParseShared(filter); err != nil || !topic.ValidFilter(f) {
+						code = protocol.ReasonTopicFilterInvalid
+					} else if !s.broker.Unsubscribe(filter, cli.ID()) {
+						code = protocol.ReasonNoSubscriptionExisted
+					}
+					if version == protocol.Version5 {
+						ack.ReasonCodes = append(ack.ReasonCodes, code)
+					}
+				}
+
+				if err := cli.Send(ack); err != nil {
+					log.Printf("unsuback error: %v", err)
+					return
+				}
+
 			case *protocol.PublishPacket:
-				var buf bytes.Buffer
-				if err := protocol.EncodePublish(&buf, p.Topic, p.Payload); err != nil {
-					log.Printf("publish encode error: %v", err)
+				if code := aliases.resolve(p, s.topicAliasMaximum); code != protocol.ReasonSuccess {
+					log.Printf("client %s sent an invalid topic alias", cli.ID())
+					disconnect(code)
+					return
+				}
+
+				// A QoS 2 message is delivered once, when its packet identifier
+				// is first seen; retransmissions only get a new PUBREC. MQTT 5
+				// clients may not have more of them unreleased than the
+				// Receive Maximum of the server.
+				deliver := p.QoS < 2
+				if p.QoS == 2 {
+					limit := 0
+					if version == protocol.Version5 {
+						limit = int(s.receiveMaximum)
+					}
+					deliver, err = cli.StoreInbound(p.PacketID, limit)
+					if errors.Is(err, client.ErrReceiveMaximumExceeded) {
+						log.Printf("client %s exceeded the receive maximum", cli.ID())
+						disconnect(protocol.ReasonReceiveMaximumExceeded)
+						return
+					}
+				}
+				if deliver {
+					s.broker.Publish(message(p, cli.ID()))
+				}
+
+				var ack protocol.Packet
+				switch p.QoS {
+				case 1:
+					ack = &protocol.PubAckPacket{PacketID: p.PacketID}
+				case 2:
+					ack = &protocol.PubRecPacket{PacketID: p.PacketID}
+				}
+
+				if ack != nil {
+					if err := cli.Send(ack); err != nil {
+						log.Printf("publish ack error: %v", err)
+						return
+					}
+				}
+
+			case *protocol.PubRelPacket:
+				cli.ReleaseInbound(p.PacketID)
+
+				if err := cli.Send(&protocol.PubCompPacket{PacketID: p.PacketID}); err != nil {
+					log.Printf("pubcomp error: %v", err)
 					return
 				}
 
-				s.broker.Publish(p, buf.Bytes())
+			case *protocol.PubAckPacket:
+				if !cli.Ack(p.PacketID) {
+					log.Printf("client %s sent PUBACK for unknown packet %d", cli.ID(), p.PacketID)
+				}
+
+			case *protocol.PubRecPacket:
+				if !cli.Release(p.PacketID) {
+					log.Printf("client %s sent PUBREC for unknown packet %d", cli.ID(), p.PacketID)
+				}
+
+			case *protocol.PubCompPacket:
+				if !cli.Complete(p.PacketID) {
+					log.Printf("client %s sent PUBCOMP for unknown packet %d", cli.ID(), p.PacketID)
+				}
 
 			case *protocol.DisconnectPacket:
 				log.Printf("client %s sent DISCONNECT", cli.ID())
+				// MQTT 5 clients may change their session expiry interval,
+				// but not keep a session that was to end with the connection.
+				if p.Properties != nil && p.Properties.SessionExpiry != nil {
+					expiry := *p.Properties.SessionExpiry
+					if requestedExpiry == 0 && expiry != 0 {
+						log.Printf("client %s set a session expiry interval on DISCONNECT", cli.ID())
+						disconnect(protocol.ReasonProtocolError)
+						return
+					}
+					grantedExpiry = s.capSessionExpiry(expiry)
+					s.broker.SetSessionExpiry(cli, grantedExpiry)
+				}
+				// MQTT 5 clients may ask for their will to be published.
+				if p.ReasonCode != protocol.ReasonDisconnectWithWillMessage {
+					will = nil
+				}
+				return
+
+			case *protocol.AuthPacket:
+				// Only sent during extended authentication, which no client
+				// can have started.
+				log.Printf("client %s sent AUTH", cli.ID())
+				disconnect(protocol.ReasonProtocolError)
 				return
 
 			default:
@@ -140,3 +686,243 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 		}
 	}
 }
+
+// connAckProperties returns the properties of the CONNACK accepting an
+// MQTT 5 client: the identifier the server assigned to it, the keep-alive
+// and session expiry interval enforced by the server when they differ from
+// the requested ones, the number of topic aliases the client may use, and
+// the limits of the server on unreleased QoS 2 messages and on the size of
+// packets, maxPacketSize being the one of the client's listener. It
+// returns nil when there are none.
+func (s *Server) connAckProperties(connect *protocol.ConnectPacket, assigned bool, keepAlive time.Duration, maxPacketSize int) *protocol.Properties {
+	var props protocol.Properties
+
+	if max := s.topicAliasMaximum; max > 0 {
+		props.TopicAliasMaximum = &max
+	}
+
+	// 65535 is what clients assume when the property is absent.
+	if max := s.receiveMaximum; max < 65535 {
+		props.ReceiveMaximum = &max
+	}
+
+	if maxPacketSize > 0 {
+		size := uint32(maxPacketSize)
+		props.MaximumPacketSize = &size
+	}
+
+	if assigned {
+		props.AssignedClientID = connect.ClientID
+	}
+
+	if seconds := uint16(min(keepAlive/time.Second, 65535)); seconds != connect.KeepAlive {
+		props.ServerKeepAlive = &seconds
+	}
+
+	requested := sessionExpiry(connect)
+	if granted := s.capSessionExpiry(requested); granted != requested {
+		props.SessionExpiry = &granted
+	}
+
+	if reflect.ValueOf(props).IsZero() {
+		return nil
+	}
+
+	return &props
+}
+
+// connParams returns the parameters of the connection of a client, from
+// the limits it set in its CONNECT.
+func connParams(connect *protocol.ConnectPacket) client.ConnParams {
+	params := client.ConnParams{Version: connect.ProtocolLevel}
+
+	if props := connect.Properties; props != nil {
+		if props.TopicAliasMaximum != nil {
+			params.TopicAliasMaximum = *props.TopicAliasMaximum
+		}
+		if props.ReceiveMaximum != nil {
+			params.ReceiveMaximum = *props.ReceiveMaximum
+		}
+		if props.MaximumPacketSize != nil {
+			params.MaximumPacketSize = *props.MaximumPacketSize
+		}
+	}
+
+	return params
+}
+
+// keepAlive returns the keep-alive interval enforced on a client that asked
+// for the given one, in seconds. Zero means no keep-alive.
+//
+// MQTT 3.1.1 clients that disabled keep-alive are left alone: they cannot
+// be told about another interval, so they would never send the PINGREQ
+// that keeps them connected.
+func (s *Server) keepAlive(requested uint16, version byte) time.Duration {
+	if requested == 0 && version != protocol.Version5 {
+		return 0
+	}
+
+	if s.keepAliveOverride > 0 {
+		return s.keepAliveOverride
+	}
+
+	keepAlive := time.Duration(requested) * time.Second
+	if s.maxKeepAlive > 0 && (keepAlive == 0 || keepAlive > s.maxKeepAlive) {
+		return s.maxKeepAlive
+	}
+
+	return keepAlive
+}
+
+// sessionExpiry returns the session expiry interval a client asked for in
+// its CONNECT, in seconds: the Session Expiry Interval of an MQTT 5 client,
+// 0 by default, or the interval matching the CleanSession flag of an
+// MQTT 3.1.1 client.
+func sessionExpiry(connect *protocol.ConnectPacket) uint32 {
+	if connect.ProtocolLevel != protocol.Version5 {
+		if connect.CleanSession {
+			return 0
+		}
+		return broker.NeverExpire
+	}
+
+	if connect.Properties == nil || connect.Properties.SessionExpiry == nil {
+		return 0
+	}
+	return *connect.Properties.SessionExpiry
+}
+
+// capSessionExpiry returns the session expiry interval granted to a client
+// that asked for the given one, in seconds.
+func (s *Server) capSessionExpiry(requested uint32) uint32 {
+	if s.maxSessionExpiry <= 0 {
+		return requested
+	}
+	return uint32(min(uint64(requested), uint64(s.maxSessionExpiry/time.Second)))
+}
+
+// Clients returns the clients that are currently connected, sorted by
+// client identifier.
+func (s *Server) Clients() []ClientInfo {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	clients := make([]ClientInfo, 0, len(s.conns))
+	for id, lc := range s.conns {
+		clients = append(clients, ClientInfo{
+			ClientID:   id,
+			RemoteAddr: lc.conn.RemoteAddr().String(),
+			AssignedID: lc.assigned,
+		})
+	}
+
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+
+	return clients
+}
+
+// assignClientID returns a new identifier for a client that connected with
+// an empty ClientID.
+func (s *Server) assignClientID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:]) // never returns an error
+	return s.clientIDPrefix + hex.EncodeToString(b[:])
+}
+
+// takeOver registers conn as the live connection of clientID. If another
+// connection is registered under the same identifier it is closed, and
+// takeOver waits until that connection has been torn down.
+func (s *Server) takeOver(clientID string, conn net.Conn, assigned bool) *liveConn {
+	lc := &liveConn{
+		conn:     conn,
+		assigned: assigned,
+		done:     make(chan struct{}),
+	}
+
+	s.connsMu.Lock()
+	prev := s.conns[clientID]
+	s.conns[clientID] = lc
+	s.connsMu.Unlock()
+
+	if prev != nil {
+		log.Printf("client %s connected again, closing previous connection", clientID)
+		_ = prev.conn.Close()
+		<-prev.done
+	}
+
+	return lc
+}
+
+// release unregisters a connection registered by takeOver, unless a newer
+// connection has taken its place, and signals that it has been torn down.
+func (s *Server) release(clientID string, lc *liveConn) {
+	s.connsMu.Lock()
+	if s.conns[clientID] == lc {
+		delete(s.conns, clientID)
+	}
+	s.connsMu.Unlock()
+
+	close(lc.done)
+}
+
+// message returns the application message carried by a PUBLISH packet
+// sent by the client clientID.
+func message(p *protocol.PublishPacket, clientID string) topic.Message {
+	return topic.Message{
+		Topic:      p.Topic,
+		Payload:    p.Payload,
+		QoS:        p.QoS,
+		Retain:     p.Retain,
+		Properties: messageProperties(p.Properties),
+		From:       clientID,
+		Expiry:     topic.ExpiresAt(p.Properties),
+	}
+}
+
+// messageProperties returns the properties of a PUBLISH or of a will that
+// travel with the message to its subscribers: all of them but the
+// subscription identifiers, which are set for each subscriber, and the
+// will delay. The topic alias has already been resolved. It returns nil
+// when there are none.
+func messageProperties(p *protocol.Properties) *protocol.Properties {
+	if p == nil {
+		return nil
+	}
+
+	props := *p
+	props.SubscriptionIdentifiers = nil
+	props.WillDelay = nil
+
+	if reflect.ValueOf(props).IsZero() {
+		return nil
+	}
+	return &props
+}
+
+// subscribeFailure returns the SUBACK return code refusing an invalid
+// topic filter. MQTT 3.1.1 only has 0x80, Failure.
+func subscribeFailure(version byte) byte {
+	if version == protocol.Version5 {
+		return byte(protocol.ReasonTopicFilterInvalid)
+	}
+	return 0x80
+}
+
+// willMessage returns the will message registered by a CONNECT packet of
+// the client clientID, or nil if the client did not register one.
+func willMessage(connect *protocol.ConnectPacket, clientID string) *topic.Message {
+	if !connect.WillFlag {
+		return nil
+	}
+
+	return &topic.Message{
+		Topic:      connect.WillTopic,
+		Payload:    connect.WillMessage,
+		QoS:        connect.WillQoS,
+		Retain:     connect.WillRetain,
+		Properties: messageProperties(connect.WillProperties),
+		From:       clientID,
+	}
+}
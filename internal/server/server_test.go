@@ -0,0 +1,1038 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/broker"
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// testConn is the client side of an in-memory connection served by
+// handleConn.
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func serve(t *testing.T, s *Server) *testConn {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv, cli := net.Pipe()
+	go s.handleConn(ctx, srv, s.maxPacketSize)
+	t.Cleanup(func() { cli.Close() })
+
+	return &testConn{Conn: cli, r: bufio.NewReader(cli)}
+}
+
+// deadlineConn is the server side of an in-memory connection, reporting
+// every read deadline set by handleConn.
+type deadlineConn struct {
+	net.Conn
+	deadlines chan time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	select {
+	case c.deadlines <- t:
+	default:
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// serveDeadlines is like serve, and also returns the read deadlines set on
+// the server side of the connection.
+func serveDeadlines(t *testing.T, s *Server) (*testConn, <-chan time.Time) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv, cli := net.Pipe()
+	dc := &deadlineConn{Conn: srv, deadlines: make(chan time.Time, 16)}
+	go s.handleConn(ctx, dc, s.maxPacketSize)
+	t.Cleanup(func() { cli.Close() })
+
+	return &testConn{Conn: cli, r: bufio.NewReader(cli)}, dc.deadlines
+}
+
+// connectFields describes the CONNECT packet sent by testConn.connect.
+type connectFields struct {
+	clientID   string
+	persistent bool
+
+	willTopic   string
+	willMessage string
+
+	username string
+	password string
+}
+
+// connect sends a CONNECT packet and returns the CONNACK frame.
+func (c *testConn) connect(t *testing.T, f connectFields) []byte {
+	t.Helper()
+
+	flags := byte(0x02)
+	if f.persistent {
+		flags = 0x00
+	}
+
+	payload := appendString(nil, f.clientID)
+	if f.willTopic != "" {
+		flags |= 0x04
+		payload = appendString(payload, f.willTopic)
+		payload = appendString(payload, f.willMessage)
+	}
+	if f.username != "" {
+		flags |= 0x80
+		payload = appendString(payload, f.username)
+	}
+	if f.password != "" {
+		flags |= 0x40
+		payload = appendString(payload, f.password)
+	}
+
+	body := append([]byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, flags, 0x00, 0x3C}, payload...)
+	_, err := c.Write(append([]byte{0x10, byte(len(body))}, body...))
+	require.NoError(t, err)
+
+	frame := c.readFrame(t)
+	require.Equal(t, []byte{0x20, 0x02}, frame[:2], "expected CONNACK")
+	return frame
+}
+
+// subscribe subscribes to a single filter and waits for the SUBACK.
+func (c *testConn) subscribe(t *testing.T, filter string, qos byte) {
+	t.Helper()
+
+	body := append([]byte{0x00, 0x01}, appendString(nil, filter)...)
+	body = append(body, qos)
+	_, err := c.Write(append([]byte{0x82, byte(len(body))}, body...))
+	require.NoError(t, err)
+
+	frame := c.readFrame(t)
+	require.Equal(t, byte(0x90), frame[0], "expected SUBACK")
+}
+
+// readFrame reads a single packet and returns its raw bytes.
+func (c *testConn) readFrame(t *testing.T) []byte {
+	t.Helper()
+
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+
+	header, err := c.r.ReadByte()
+	require.NoError(t, err)
+	length, err := c.r.ReadByte()
+	require.NoError(t, err)
+	require.Less(t, length, byte(128), "test frames are short")
+
+	frame := make([]byte, 2+int(length))
+	frame[0], frame[1] = header, length
+	_, err = io.ReadFull(c.r, frame[2:])
+	require.NoError(t, err)
+
+	return frame
+}
+
+// send encodes a packet and writes it.
+func (c *testConn) send(t *testing.T, p protocol.Packet) {
+	t.Helper()
+
+	require.NoError(t, protocol.Encode(c, p))
+}
+
+// readPacket reads a single packet and decodes it.
+func (c *testConn) readPacket(t *testing.T) protocol.Packet {
+	t.Helper()
+
+	p, err := protocol.Decode(bytes.NewReader(c.readFrame(t)))
+	require.NoError(t, err)
+
+	return p
+}
+
+// send5 encodes a packet in the MQTT 5 format and writes it.
+func (c *testConn) send5(t *testing.T, p protocol.Packet) {
+	t.Helper()
+
+	require.NoError(t, protocol.EncodeVersion(c, p, protocol.Version5))
+}
+
+// readPacket5 reads a single packet and decodes it in the MQTT 5 format.
+func (c *testConn) readPacket5(t *testing.T) protocol.Packet {
+	t.Helper()
+
+	p, err := protocol.DecodeVersion(bytes.NewReader(c.readFrame(t)), protocol.Version5)
+	require.NoError(t, err)
+
+	return p
+}
+
+// closed reports whether the server closed the connection.
+func (c *testConn) closed(t *testing.T) bool {
+	t.Helper()
+
+	// net.Pipe refuses to set a deadline once the other end is closed.
+	if err := c.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		return err == io.ErrClosedPipe
+	}
+
+	_, err := c.r.ReadByte()
+	return err == io.EOF
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func TestAuthenticator(t *testing.T) {
+	auth := AuthenticatorFunc(func(connect *protocol.ConnectPacket) error {
+		switch {
+		case connect.Username == nil:
+			return ErrNotAuthorized
+		case *connect.Username != "alice" || connect.Password == nil || *connect.Password != "secret":
+			return ErrBadCredentials
+		default:
+			return nil
+		}
+	})
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     protocol.ConnAckReturnCode
+	}{
+		{name: "accepted", username: "alice", password: "secret", want: protocol.ConnAckAccepted},
+		{name: "wrong password", username: "alice", password: "guess", want: protocol.ConnAckBadUsernameOrPassword},
+		{name: "anonymous", want: protocol.ConnAckNotAuthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", broker.New(), WithAuthenticator(auth))
+			conn := serve(t, s)
+
+			connack := conn.connect(t, connectFields{
+				clientID: "dev-1",
+				username: tt.username,
+				password: tt.password,
+			})
+			assert.Equal(t, byte(tt.want), connack[3])
+
+			if tt.want != protocol.ConnAckAccepted {
+				assert.True(t, conn.closed(t), "refused clients are disconnected")
+			}
+		})
+	}
+}
+
+func TestClientIDTakeover(t *testing.T) {
+	s := New("", broker.New())
+
+	watcher := serve(t, s)
+	watcher.connect(t, connectFields{clientID: "watcher"})
+	watcher.subscribe(t, "status/#", 0)
+
+	first := serve(t, s)
+	first.connect(t, connectFields{
+		clientID:    "dev",
+		persistent:  true,
+		willTopic:   "status/dev",
+		willMessage: "lost",
+	})
+	first.subscribe(t, "cmd/#", 1)
+
+	second := serve(t, s)
+	connack := second.connect(t, connectFields{clientID: "dev", persistent: true})
+	assert.Equal(t, byte(0x01), connack[2], "the session is handed over")
+	assert.True(t, first.closed(t), "the previous connection is closed")
+
+	will := watcher.readFrame(t)
+	assert.Equal(t, byte(0x30), will[0])
+	assert.Contains(t, string(will), "status/dev")
+	assert.Contains(t, string(will), "lost")
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+	_, err := pub.Write([]byte{0x30, 0x0C, 0x00, 0x0A, 'c', 'm', 'd', '/', 'r', 'e', 'b', 'o', 'o', 't'})
+	require.NoError(t, err)
+
+	msg := second.readFrame(t)
+	assert.Equal(t, byte(0x30), msg[0], "subscriptions survive the takeover")
+	assert.Contains(t, string(msg), "cmd/reboot")
+}
+
+func TestAssignedClientIDs(t *testing.T) {
+	s := New("", broker.New(), WithClientIDPrefix("auto-"))
+
+	a := serve(t, s)
+	a.connect(t, connectFields{})
+	a.subscribe(t, "a", 0)
+
+	b := serve(t, s)
+	b.connect(t, connectFields{})
+	b.subscribe(t, "b", 0)
+
+	clients := s.Clients()
+	require.Len(t, clients, 2)
+	for _, c := range clients {
+		assert.True(t, c.AssignedID)
+		assert.True(t, strings.HasPrefix(c.ClientID, "auto-"), c.ClientID)
+	}
+	assert.NotEqual(t, clients[0].ClientID, clients[1].ClientID)
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+	_, err := pub.Write([]byte{0x30, 0x04, 0x00, 0x01, 'a', '1'})
+	require.NoError(t, err)
+	_, err = pub.Write([]byte{0x30, 0x04, 0x00, 0x01, 'b', '2'})
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 'a', '1'}, a.readFrame(t), "subscriptions are kept apart")
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 'b', '2'}, b.readFrame(t))
+}
+
+func TestReservedClientIDs(t *testing.T) {
+	s := New("", broker.New())
+
+	conn := serve(t, s)
+	conn.send(t, &protocol.ConnectPacket{ProtocolLevel: 0x04, ClientID: ReservedClientIDPrefix + "1"})
+	assert.Equal(t, []byte{0x20, 0x02, 0x00, 0x02}, conn.readFrame(t))
+	assert.True(t, conn.closed(t))
+
+	conn = serve(t, s)
+	conn.send5(t, &protocol.ConnectPacket{ProtocolLevel: protocol.Version5, ClientID: ReservedClientIDPrefix + "1"})
+	assert.Equal(t, []byte{0x20, 0x03, 0x00, 0x85, 0x00}, conn.readFrame(t))
+	assert.True(t, conn.closed(t))
+
+	assert.Empty(t, s.Clients())
+}
+
+// chanSub is an in-process subscriber that forwards every message it
+// receives to a channel.
+type chanSub chan topic.Message
+
+func (c chanSub) ID() string {
+	return "chan"
+}
+
+func (c chanSub) Deliver(msg topic.Message) error {
+	c <- msg
+	return nil
+}
+
+func TestKeepAliveExpiry(t *testing.T) {
+	b := broker.New()
+	s := New("", b, WithKeepAliveOverride(100*time.Millisecond))
+
+	watcher := make(chanSub, 1)
+	b.Subscribe("status/#", watcher, 0)
+
+	dev := serve(t, s)
+	dev.connect(t, connectFields{
+		clientID:    "dev",
+		willTopic:   "status/dev",
+		willMessage: "lost",
+	})
+
+	assert.True(t, dev.closed(t), "a silent client is disconnected")
+
+	select {
+	case will := <-watcher:
+		assert.Equal(t, "status/dev", will.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("will was not published")
+	}
+}
+
+func TestKeepAliveLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		version   byte
+		requested uint16
+		want      time.Duration
+	}{
+		{name: "client value", version: protocol.Version311, requested: 60, want: time.Minute},
+		{name: "disabled by client", version: protocol.Version311, requested: 0, want: 0},
+		{name: "capped", opts: []Option{WithMaxKeepAlive(time.Minute)}, version: protocol.Version311, requested: 600, want: time.Minute},
+		{name: "MQTT 5 disabled under cap", opts: []Option{WithMaxKeepAlive(time.Minute)}, version: protocol.Version5, requested: 0, want: time.Minute},
+		{name: "disabled under cap", opts: []Option{WithMaxKeepAlive(time.Minute)}, version: protocol.Version311, requested: 0, want: 0},
+		{name: "override", opts: []Option{WithKeepAliveOverride(5 * time.Second)}, version: protocol.Version311, requested: 60, want: 5 * time.Second},
+		{name: "disabled under override", opts: []Option{WithKeepAliveOverride(5 * time.Second)}, version: protocol.Version311, requested: 0, want: 0},
+		{name: "MQTT 5 disabled under override", opts: []Option{WithKeepAliveOverride(5 * time.Second)}, version: protocol.Version5, requested: 0, want: 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("", broker.New(), tt.opts...)
+			assert.Equal(t, tt.want, s.keepAlive(tt.requested, tt.version))
+		})
+	}
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	s := New("", broker.New(), WithMaxKeepAlive(100*time.Millisecond))
+
+	conn, deadlines := serveDeadlines(t, s)
+	body := appendString([]byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x00}, "idle")
+	_, err := conn.Write(append([]byte{0x10, byte(len(body))}, body...))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x20, 0x02, 0x00, 0x00}, conn.readFrame(t), "expected CONNACK")
+
+	// The first deadline bounds the wait for CONNECT, the next one the
+	// wait for the first packet after CONNACK.
+	<-deadlines
+	select {
+	case deadline := <-deadlines:
+		assert.True(t, deadline.IsZero(), "the idle client has a read deadline")
+	case <-time.After(time.Second):
+		t.Fatal("no read deadline set after CONNACK")
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	s := New("", broker.New(), WithMaxPacketSize(64))
+
+	conn := serve(t, s)
+	conn.connect(t, connectFields{clientID: "dev"})
+
+	body := append(appendString(nil, "a"), make([]byte, 100)...)
+	// The server may hang up before the whole packet is written.
+	_, _ = conn.Write(append([]byte{0x30, byte(len(body))}, body...))
+	assert.True(t, conn.closed(t), "oversized packets end the connection")
+}
+
+func TestDefaultMaxPacketSize(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect(t, connectFields{clientID: "sub"})
+	sub.subscribe(t, "a", 0)
+
+	// Without a limit, packets of any size allowed by the protocol get
+	// through.
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+	pub.send(t, &protocol.PublishPacket{Topic: "a", Payload: make([]byte, 2<<20)})
+
+	pkt, err := protocol.Decode(sub.r)
+	require.NoError(t, err)
+	p, ok := pkt.(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Len(t, p.Payload, 2<<20)
+}
+
+func TestMQTT5Client(t *testing.T) {
+	s := New("", broker.New(), WithClientIDPrefix("auto-"), WithMaxKeepAlive(time.Minute))
+
+	v5 := serve(t, s)
+	v5.send5(t, &protocol.ConnectPacket{ProtocolLevel: protocol.Version5, CleanSession: true, KeepAlive: 600})
+
+	connack, ok := v5.readPacket5(t).(*protocol.ConnAckPacket)
+	require.True(t, ok, "expected CONNACK")
+	assert.Equal(t, protocol.ReasonSuccess, connack.ReturnCode)
+	require.NotNil(t, connack.Properties)
+	assert.True(t, strings.HasPrefix(connack.Properties.AssignedClientID, "auto-"), "the assigned identifier is reported")
+	require.NotNil(t, connack.Properties.ServerKeepAlive)
+	assert.Equal(t, uint16(60), *connack.Properties.ServerKeepAlive, "the enforced keep-alive is reported")
+
+	v5.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "a", QoS: 0}},
+	})
+	assert.Equal(t, []byte{0x90, 0x04, 0x00, 0x01, 0x00, 0x00}, v5.readFrame(t))
+
+	v3 := serve(t, s)
+	v3.connect(t, connectFields{clientID: "v3"})
+	v3.subscribe(t, "a", 0)
+
+	_, err := v3.Write([]byte{0x30, 0x04, 0x00, 0x01, 'a', '1'})
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x30, 0x05, 0x00, 0x01, 'a', 0x00, '1'}, v5.readFrame(t), "MQTT 5 subscribers get MQTT 5 frames")
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 'a', '1'}, v3.readFrame(t))
+
+	v5.send5(t, &protocol.UnsubscribePacket{PacketID: 2, Topics: []string{"a", "b"}})
+	assert.Equal(t, &protocol.UnsubAckPacket{
+		PacketID:    2,
+		ReasonCodes: []protocol.ReasonCode{protocol.ReasonSuccess, protocol.ReasonNoSubscriptionExisted},
+	}, v5.readPacket5(t))
+
+	v5.send5(t, &protocol.AuthPacket{ReasonCode: protocol.ReasonReAuthenticate})
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonProtocolError}, v5.readPacket5(t))
+	assert.True(t, v5.closed(t))
+}
+
+func TestMQTT5Refused(t *testing.T) {
+	s := New("", broker.New(), WithAuthenticator(AuthenticatorFunc(
+		func(connect *protocol.ConnectPacket) error {
+			return ErrBadCredentials
+		},
+	)))
+
+	conn := serve(t, s)
+	conn.send5(t, &protocol.ConnectPacket{ProtocolLevel: protocol.Version5, ClientID: "dev"})
+	assert.Equal(t, []byte{0x20, 0x03, 0x00, 0x86, 0x00}, conn.readFrame(t))
+	assert.True(t, conn.closed(t))
+
+	conn = serve(t, s)
+	conn.send5(t, &protocol.ConnectPacket{
+		ProtocolLevel: protocol.Version5,
+		ClientID:      "dev",
+		Properties:    &protocol.Properties{AuthMethod: "SCRAM-SHA-1"},
+	})
+	assert.Equal(t, []byte{0x20, 0x03, 0x00, 0x8C, 0x00}, conn.readFrame(t), "extended authentication is not supported")
+
+	conn = serve(t, s)
+	conn.send(t, &protocol.ConnectPacket{ProtocolLevel: 0x03, ClientID: "dev"})
+	assert.Equal(t, []byte{0x20, 0x02, 0x00, 0x01}, conn.readFrame(t), "unknown versions are refused in the MQTT 3.1.1 format")
+	assert.True(t, conn.closed(t))
+}
+
+func TestMQTT5DisconnectWithWill(t *testing.T) {
+	b := broker.New()
+	s := New("", b)
+
+	watcher := make(chanSub, 1)
+	b.Subscribe("status/#", watcher, 0)
+
+	dev := serve(t, s)
+	dev.send5(t, &protocol.ConnectPacket{
+		ProtocolLevel: protocol.Version5,
+		ClientID:      "dev",
+		CleanSession:  true,
+		WillFlag:      true,
+		WillTopic:     "status/dev",
+		WillMessage:   []byte("bye"),
+	})
+	dev.readFrame(t)
+
+	dev.send5(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonDisconnectWithWillMessage})
+
+	select {
+	case will := <-watcher:
+		assert.Equal(t, "bye", string(will.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("will was not published")
+	}
+}
+
+func TestWillDelay(t *testing.T) {
+	b := broker.New()
+	s := New("", b)
+
+	watcher := make(chanSub, 1)
+	b.Subscribe("status/#", watcher, 0)
+
+	connect := func(clientID string, clean bool, sessionExpiry uint32) *testConn {
+		delay := uint32(60)
+		conn := serve(t, s)
+		conn.send5(t, &protocol.ConnectPacket{
+			ProtocolLevel:  protocol.Version5,
+			ClientID:       clientID,
+			CleanSession:   clean,
+			Properties:     &protocol.Properties{SessionExpiry: &sessionExpiry},
+			WillFlag:       true,
+			WillTopic:      "status/" + clientID,
+			WillMessage:    []byte("lost"),
+			WillProperties: &protocol.Properties{WillDelay: &delay},
+		})
+		_, ok := conn.readPacket5(t).(*protocol.ConnAckPacket)
+		require.True(t, ok, "expected CONNACK")
+		return conn
+	}
+	published := func(wait time.Duration) bool {
+		select {
+		case <-watcher:
+			return true
+		case <-time.After(wait):
+			return false
+		}
+	}
+
+	connect("dev", true, 3600).Close()
+	assert.False(t, published(100*time.Millisecond), "the will waits for its delay")
+
+	dev := connect("dev", false, 3600)
+	dev.Close()
+	assert.False(t, published(100*time.Millisecond), "reconnecting within the delay cancels the will")
+
+	connect("dev", true, 3600)
+	assert.True(t, published(time.Second), "a clean start ends the session, which publishes the will")
+
+	connect("tmp", true, 1).Close()
+	assert.False(t, published(500*time.Millisecond))
+	assert.True(t, published(time.Second), "the will is published when the session expires, before its delay")
+}
+
+func TestWillDelayRace(t *testing.T) {
+	b := broker.New()
+	s := New("", b)
+
+	watcher := make(chanSub, 1)
+	b.Subscribe("status/#", watcher, 0)
+
+	// The timer fires as the client connects again with a clean start: the
+	// will is published once, by one or the other.
+	for range 200 {
+		s.delayWill("dev", topic.Message{Topic: "status/dev", Payload: []byte("lost")}, nil, time.Millisecond)
+		time.Sleep(time.Millisecond)
+		s.cancelWill("dev", true)
+
+		select {
+		case <-watcher:
+		case <-time.After(time.Second):
+			t.Fatal("will was lost")
+		}
+		select {
+		case <-watcher:
+			t.Fatal("will was published twice")
+		case <-time.After(2 * time.Millisecond):
+		}
+	}
+}
+
+func TestQoSFlows(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect(t, connectFields{clientID: "sub"})
+	sub.subscribe(t, "q/#", 2)
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+
+	// QoS 1: PUBLISH, PUBACK.
+	pub.send(t, &protocol.PublishPacket{Topic: "q/1", Payload: []byte("x"), QoS: 1, PacketID: 10})
+	assert.Equal(t, &protocol.PubAckPacket{PacketID: 10}, pub.readPacket(t))
+
+	got, ok := sub.readPacket(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, byte(1), got.QoS)
+	sub.send(t, &protocol.PubAckPacket{PacketID: got.PacketID})
+
+	// QoS 2: PUBLISH, PUBREC, PUBREL, PUBCOMP, in both directions.
+	pub.send(t, &protocol.PublishPacket{Topic: "q/2", Payload: []byte("y"), QoS: 2, PacketID: 11})
+	assert.Equal(t, &protocol.PubRecPacket{PacketID: 11}, pub.readPacket(t))
+	pub.send(t, &protocol.PubRelPacket{PacketID: 11})
+	assert.Equal(t, &protocol.PubCompPacket{PacketID: 11}, pub.readPacket(t))
+
+	got, ok = sub.readPacket(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, byte(2), got.QoS)
+	sub.send(t, &protocol.PubRecPacket{PacketID: got.PacketID})
+	assert.Equal(t, &protocol.PubRelPacket{PacketID: got.PacketID}, sub.readPacket(t))
+	sub.send(t, &protocol.PubCompPacket{PacketID: got.PacketID})
+}
+
+func TestSessionRetransmit(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect(t, connectFields{clientID: "sub", persistent: true})
+	sub.subscribe(t, "q/#", 2)
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub", persistent: true})
+	pub.send(t, &protocol.PublishPacket{Topic: "q/1", Payload: []byte("x"), QoS: 1, PacketID: 1})
+	pub.readPacket(t)
+	pub.send(t, &protocol.PublishPacket{Topic: "q/2", Payload: []byte("y"), QoS: 2, PacketID: 2})
+	assert.Equal(t, &protocol.PubRecPacket{PacketID: 2}, pub.readPacket(t))
+
+	first, ok := sub.readPacket(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	second, ok := sub.readPacket(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	sub.send(t, &protocol.PubRecPacket{PacketID: second.PacketID})
+	sub.readPacket(t)
+
+	// Both clients lose their connection before finishing the exchanges.
+	sub.Close()
+	pub.Close()
+
+	sub = serve(t, s)
+	sub.connect(t, connectFields{clientID: "sub", persistent: true})
+	again, ok := sub.readPacket(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, first.PacketID, again.PacketID)
+	assert.True(t, again.Dup, "unacknowledged messages are sent again as duplicates")
+	assert.Equal(t, &protocol.PubRelPacket{PacketID: second.PacketID}, sub.readPacket(t),
+		"received QoS 2 messages get their PUBREL again")
+
+	// The publisher sends its QoS 2 message again, which must not be
+	// delivered twice.
+	pub = serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub", persistent: true})
+	pub.send(t, &protocol.PublishPacket{Topic: "q/2", Payload: []byte("y"), QoS: 2, PacketID: 2, Dup: true})
+	assert.Equal(t, &protocol.PubRecPacket{PacketID: 2}, pub.readPacket(t))
+	pub.send(t, &protocol.PubRelPacket{PacketID: 2})
+	assert.Equal(t, &protocol.PubCompPacket{PacketID: 2}, pub.readPacket(t))
+	pub.send(t, &protocol.PublishPacket{Topic: "q/3", Payload: []byte("z")})
+
+	assert.Equal(t, &protocol.PublishPacket{Topic: "q/3", Payload: []byte("z")}, sub.readPacket(t),
+		"the retransmitted QoS 2 message is not delivered again")
+}
+
+// connect5 sends an MQTT 5 CONNECT packet with the given properties and
+// returns the CONNACK.
+func (c *testConn) connect5(t *testing.T, clientID string, props *protocol.Properties) *protocol.ConnAckPacket {
+	t.Helper()
+
+	c.send5(t, &protocol.ConnectPacket{
+		ProtocolLevel: protocol.Version5,
+		ClientID:      clientID,
+		CleanSession:  true,
+		Properties:    props,
+	})
+
+	connack, ok := c.readPacket5(t).(*protocol.ConnAckPacket)
+	require.True(t, ok, "expected CONNACK")
+	require.Equal(t, protocol.ReasonSuccess, connack.ReturnCode)
+
+	return connack
+}
+
+func TestInvalidTopics(t *testing.T) {
+	s := New("", broker.New())
+
+	conn := serve(t, s)
+	conn.connect(t, connectFields{clientID: "dev"})
+	body := []byte{0x00, 0x01}
+	for _, sub := range []struct {
+		filter string
+		qos    byte
+	}{{"a/#/b", 0}, {"a", 1}, {"a+", 0}, {"$share/g/b#", 0}} {
+		body = append(appendString(body, sub.filter), sub.qos)
+	}
+	_, err := conn.Write(append([]byte{0x82, byte(len(body))}, body...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x90, 0x06, 0x00, 0x01, 0x80, 0x01, 0x80, 0x80}, conn.readFrame(t),
+		"invalid filters are refused one by one")
+
+	_, err = conn.Write([]byte{0x30, 0x05, 0x00, 0x03, 'a', '/', '+'})
+	require.NoError(t, err)
+	assert.True(t, conn.closed(t), "a wildcard in a topic name ends the connection")
+}
+
+func TestUnsubscribe(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect(t, connectFields{clientID: "sub"})
+	sub.subscribe(t, "a", 0)
+	sub.subscribe(t, "b", 0)
+
+	sub.send(t, &protocol.UnsubscribePacket{PacketID: 7, Topics: []string{"a"}})
+	assert.Equal(t, &protocol.UnsubAckPacket{PacketID: 7}, sub.readPacket(t))
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+	_, err := pub.Write([]byte{0x30, 0x04, 0x00, 0x01, 'a', '1'})
+	require.NoError(t, err)
+	_, err = pub.Write([]byte{0x30, 0x04, 0x00, 0x01, 'b', '2'})
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x30, 0x04, 0x00, 0x01, 'b', '2'}, sub.readFrame(t),
+		"only the remaining filter receives messages")
+}
+
+func TestInvalidTopicsMQTT5(t *testing.T) {
+	s := New("", broker.New())
+
+	v5 := serve(t, s)
+	v5.connect5(t, "v5", nil)
+	v5.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "a/#/b"}, {Topic: "a"}, {Topic: ""}},
+	})
+	assert.Equal(t, []byte{0x90, 0x06, 0x00, 0x01, 0x00, 0x8F, 0x00, 0x8F}, v5.readFrame(t))
+
+	v5.send5(t, &protocol.UnsubscribePacket{PacketID: 2, Topics: []string{"a#", "a"}})
+	assert.Equal(t, &protocol.UnsubAckPacket{
+		PacketID:    2,
+		ReasonCodes: []protocol.ReasonCode{protocol.ReasonTopicFilterInvalid, protocol.ReasonSuccess},
+	}, v5.readPacket5(t))
+
+	v5.send5(t, &protocol.PublishPacket{Topic: "a/#", Payload: []byte("x")})
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonTopicNameInvalid}, v5.readPacket5(t))
+	assert.True(t, v5.closed(t))
+}
+
+func TestTopicAliases(t *testing.T) {
+	s := New("", broker.New(), WithTopicAliasMaximum(2))
+	aliasMax := uint16(1)
+
+	sub := serve(t, s)
+	connack := sub.connect5(t, "sub", &protocol.Properties{TopicAliasMaximum: &aliasMax})
+	require.NotNil(t, connack.Properties.TopicAliasMaximum)
+	assert.Equal(t, uint16(2), *connack.Properties.TopicAliasMaximum)
+
+	sub.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "devices/#"}},
+	})
+	sub.readFrame(t)
+
+	pub := serve(t, s)
+	pub.connect5(t, "pub", nil)
+
+	alias := func(n uint16) *protocol.Properties {
+		return &protocol.Properties{TopicAlias: &n}
+	}
+	publish := func(topic string, props *protocol.Properties) {
+		pub.send5(t, &protocol.PublishPacket{Topic: topic, Payload: []byte("x"), Properties: props})
+	}
+
+	// Inbound: the publisher defines alias 1 and then uses it alone.
+	publish("devices/42/temperature", alias(1))
+	publish("", alias(1))
+	publish("devices/7/humidity", nil)
+
+	// Outbound: the subscriber accepts one alias, taken by the first topic.
+	assert.Equal(t, &protocol.PublishPacket{
+		Topic:      "devices/42/temperature",
+		Payload:    []byte("x"),
+		Properties: alias(1),
+	}, sub.readPacket5(t))
+	assert.Equal(t, &protocol.PublishPacket{
+		Payload:    []byte("x"),
+		Properties: alias(1),
+	}, sub.readPacket5(t))
+	assert.Equal(t, &protocol.PublishPacket{
+		Topic:   "devices/7/humidity",
+		Payload: []byte("x"),
+	}, sub.readPacket5(t), "topics are sent in full once the aliases are taken")
+
+	publish("", alias(2))
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonProtocolError}, pub.readPacket5(t),
+		"undefined aliases are refused")
+	assert.True(t, pub.closed(t))
+
+	pub = serve(t, s)
+	pub.connect5(t, "pub", nil)
+	publish("devices/1", alias(3))
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonTopicAliasInvalid}, pub.readPacket5(t),
+		"aliases above the maximum are refused")
+}
+
+func TestSharedSubscriptions(t *testing.T) {
+	s := New("", broker.New())
+
+	workers := make([]*testConn, 2)
+	for i := range workers {
+		workers[i] = serve(t, s)
+		workers[i].connect(t, connectFields{clientID: "worker-" + string(rune('a'+i))})
+		workers[i].subscribe(t, "$share/workers/jobs/#", 0)
+	}
+
+	invalid := serve(t, s)
+	invalid.connect(t, connectFields{clientID: "invalid"})
+	invalid.send(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "$share/workers"}, {Topic: "jobs/#"}},
+	})
+	assert.Equal(t, &protocol.SubAckPacket{PacketID: 1, ReturnCodes: []byte{0x80, 0x00}},
+		invalid.readPacket(t), "malformed shared filters are refused")
+
+	pub := serve(t, s)
+	pub.connect(t, connectFields{clientID: "pub"})
+	for range 2 {
+		pub.send(t, &protocol.PublishPacket{Topic: "jobs/1", Payload: []byte("x")})
+	}
+
+	for _, w := range workers {
+		assert.Equal(t, &protocol.PublishPacket{Topic: "jobs/1", Payload: []byte("x")},
+			w.readPacket(t), "each worker gets one message")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s := New("", broker.New(), WithMaxSessionExpiry(time.Minute))
+	hour := uint32(3600)
+
+	resume := func() *protocol.ConnAckPacket {
+		conn := serve(t, s)
+		conn.send5(t, &protocol.ConnectPacket{
+			ProtocolLevel: protocol.Version5,
+			ClientID:      "dev",
+			Properties:    &protocol.Properties{SessionExpiry: &hour},
+		})
+
+		connack, ok := conn.readPacket5(t).(*protocol.ConnAckPacket)
+		require.True(t, ok, "expected CONNACK")
+		conn.Close()
+		return connack
+	}
+
+	dev := serve(t, s)
+	connack := dev.connect5(t, "dev", &protocol.Properties{SessionExpiry: &hour})
+	require.NotNil(t, connack.Properties.SessionExpiry)
+	assert.Equal(t, uint32(60), *connack.Properties.SessionExpiry, "the interval is capped")
+	dev.Close()
+
+	assert.True(t, resume().SessionPresent, "the session outlives its connection")
+
+	dev = serve(t, s)
+	dev.connect5(t, "dev", &protocol.Properties{SessionExpiry: &hour})
+	zero := uint32(0)
+	dev.send5(t, &protocol.DisconnectPacket{Properties: &protocol.Properties{SessionExpiry: &zero}})
+	assert.True(t, dev.closed(t))
+
+	assert.False(t, resume().SessionPresent, "DISCONNECT ended the session")
+
+	tmp := serve(t, s)
+	tmp.connect5(t, "tmp", nil)
+	tmp.send5(t, &protocol.DisconnectPacket{Properties: &protocol.Properties{SessionExpiry: &hour}})
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonProtocolError}, tmp.readPacket5(t),
+		"a session without expiry cannot be kept on DISCONNECT")
+}
+
+func TestPropertiesPassthrough(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect5(t, "sub", nil)
+	sub.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "rpc/#", QoS: 1}},
+	})
+	sub.readFrame(t)
+
+	pub := serve(t, s)
+	pub.connect5(t, "pub", nil)
+
+	props := &protocol.Properties{
+		PayloadFormat:   1,
+		ContentType:     "application/json",
+		ResponseTopic:   "rpc/reply/pub",
+		CorrelationData: []byte{0x01, 0x02},
+		UserProperties:  []protocol.UserProperty{{Key: "trace", Value: "abc"}, {Key: "trace", Value: "def"}},
+	}
+	pub.send5(t, &protocol.PublishPacket{Topic: "rpc/call", Payload: []byte("{}"), Properties: props})
+	pub.send5(t, &protocol.PublishPacket{Topic: "rpc/call", Payload: []byte("{}"), QoS: 1, PacketID: 1, Properties: props})
+
+	assert.Equal(t, &protocol.PublishPacket{
+		Topic:      "rpc/call",
+		Payload:    []byte("{}"),
+		Properties: props,
+	}, sub.readPacket5(t))
+
+	got, ok := sub.readPacket5(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, byte(1), got.QoS)
+	assert.Equal(t, props, got.Properties)
+}
+
+func TestNoLocal(t *testing.T) {
+	s := New("", broker.New())
+
+	bridge := serve(t, s)
+	bridge.connect5(t, "bridge", nil)
+	bridge.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "sync/#", NoLocal: true}},
+	})
+	bridge.readFrame(t)
+
+	bridge.send5(t, &protocol.PublishPacket{Topic: "sync/own", Payload: []byte("x")})
+
+	dev := serve(t, s)
+	dev.connect5(t, "dev", nil)
+	dev.send5(t, &protocol.PublishPacket{Topic: "sync/dev", Payload: []byte("x")})
+
+	assert.Equal(t, &protocol.PublishPacket{Topic: "sync/dev", Payload: []byte("x")},
+		bridge.readPacket5(t), "the client's own message is not sent back")
+
+	dev.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "$share/g/sync/#", NoLocal: true}},
+	})
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonProtocolError}, dev.readPacket5(t),
+		"No Local is not allowed on shared subscriptions")
+}
+
+func TestSubscriptionIdentifiers(t *testing.T) {
+	s := New("", broker.New())
+
+	sub := serve(t, s)
+	sub.connect5(t, "sub", nil)
+	sub.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "devices/+/state"}},
+		Properties:    &protocol.Properties{SubscriptionIdentifiers: []uint32{7}},
+	})
+	sub.readFrame(t)
+
+	pub := serve(t, s)
+	pub.connect5(t, "pub", nil)
+	pub.send5(t, &protocol.PublishPacket{Topic: "devices/1/state", Payload: []byte("on")})
+
+	assert.Equal(t, &protocol.PublishPacket{
+		Topic:      "devices/1/state",
+		Payload:    []byte("on"),
+		Properties: &protocol.Properties{SubscriptionIdentifiers: []uint32{7}},
+	}, sub.readPacket5(t))
+}
+
+func TestFlowControl(t *testing.T) {
+	s := New("", broker.New(), WithReceiveMaximum(1), WithMaxPacketSize(512))
+	receiveMax, maxSize := uint16(1), uint32(40)
+
+	sub := serve(t, s)
+	connack := sub.connect5(t, "sub", &protocol.Properties{ReceiveMaximum: &receiveMax, MaximumPacketSize: &maxSize})
+	require.NotNil(t, connack.Properties.ReceiveMaximum)
+	assert.Equal(t, uint16(1), *connack.Properties.ReceiveMaximum)
+	require.NotNil(t, connack.Properties.MaximumPacketSize)
+	assert.Equal(t, uint32(512), *connack.Properties.MaximumPacketSize)
+
+	sub.send5(t, &protocol.SubscribePacket{
+		PacketID:      1,
+		Subscriptions: []protocol.Subscription{{Topic: "flow/#", QoS: 1}},
+	})
+	sub.readFrame(t)
+
+	pub := serve(t, s)
+	pub.connect5(t, "pub", nil)
+	pub.send5(t, &protocol.PublishPacket{Topic: "flow/big", Payload: make([]byte, 64)})
+	pub.send5(t, &protocol.PublishPacket{Topic: "flow/a", Payload: []byte("a"), QoS: 1, PacketID: 1})
+	pub.send5(t, &protocol.PublishPacket{Topic: "flow/b", Payload: []byte("b"), QoS: 1, PacketID: 2})
+	pub.send5(t, &protocol.PublishPacket{Topic: "flow/c", Payload: []byte("c")})
+
+	first, ok := sub.readPacket5(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, "flow/a", first.Topic, "messages over the client's maximum packet size are skipped")
+
+	assert.Equal(t, &protocol.PublishPacket{Topic: "flow/c", Payload: []byte("c")}, sub.readPacket5(t),
+		"QoS 1 messages beyond the receive maximum wait for an acknowledgement")
+
+	sub.send5(t, &protocol.PubAckPacket{PacketID: first.PacketID})
+	second, ok := sub.readPacket5(t).(*protocol.PublishPacket)
+	require.True(t, ok, "expected PUBLISH")
+	assert.Equal(t, "flow/b", second.Topic)
+
+	// Inbound: the server allows one unreleased QoS 2 message.
+	for range 2 {
+		_, ok := pub.readPacket5(t).(*protocol.PubAckPacket)
+		require.True(t, ok, "expected PUBACK")
+	}
+	pub.send5(t, &protocol.PublishPacket{Topic: "other", Payload: []byte("x"), QoS: 2, PacketID: 3})
+	assert.Equal(t, &protocol.PubRecPacket{PacketID: 3}, pub.readPacket5(t))
+	pub.send5(t, &protocol.PublishPacket{Topic: "other", Payload: []byte("x"), QoS: 2, PacketID: 4})
+	assert.Equal(t, &protocol.DisconnectPacket{ReasonCode: protocol.ReasonReceiveMaximumExceeded}, pub.readPacket5(t))
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// delayedWill is the will of a client whose connection ended, waiting for
+// its Will Delay Interval to pass.
+type delayedWill struct {
+	timer *time.Timer
+	msg   topic.Message
+	props *protocol.Properties
+}
+
+// publishWill publishes the will of clientID once its connection ended, or
+// later when the client asked for a Will Delay Interval. The delay is
+// shortened to sessionExpiry, in seconds, since the will is due when the
+// session ends at the latest.
+func (s *Server) publishWill(clientID string, will topic.Message, props *protocol.Properties, sessionExpiry uint32) {
+	var delay uint32
+	if props != nil && props.WillDelay != nil {
+		delay = min(*props.WillDelay, sessionExpiry)
+	}
+
+	if delay == 0 {
+		s.sendWill(clientID, will, props)
+		return
+	}
+
+	log.Printf("delaying will of client %s by %ds", clientID, delay)
+	s.delayWill(clientID, will, props, time.Duration(delay)*time.Second)
+}
+
+// delayWill publishes the will of clientID after delay, unless cancelWill
+// or DropDelayedWills takes it first. The will belongs to whoever removes
+// it from s.wills, so it is published once at most, whatever the timer
+// does.
+func (s *Server) delayWill(clientID string, will topic.Message, props *protocol.Properties, delay time.Duration) {
+	dw := &delayedWill{msg: will, props: props}
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.wills == nil {
+		log.Printf("server stopped, dropping will of client %s", clientID)
+		return
+	}
+
+	s.wills[clientID] = dw
+	dw.timer = time.AfterFunc(delay, func() {
+		s.connsMu.Lock()
+		due := s.wills[clientID] == dw
+		if due {
+			delete(s.wills, clientID)
+		}
+		s.connsMu.Unlock()
+
+		if due {
+			s.sendWill(clientID, dw.msg, dw.props)
+		}
+	})
+}
+
+// cancelWill handles the delayed will of clientID when the client connects
+// again: it is dropped, unless the new connection starts a clean session,
+// which ends the previous one and so publishes the will right away.
+func (s *Server) cancelWill(clientID string, cleanStart bool) {
+	s.connsMu.Lock()
+	dw := s.wills[clientID]
+	delete(s.wills, clientID)
+	s.connsMu.Unlock()
+
+	if dw == nil {
+		return
+	}
+
+	// The timer may be firing already, but it finds the will gone.
+	dw.timer.Stop()
+	if cleanStart {
+		s.sendWill(clientID, dw.msg, dw.props)
+	}
+}
+
+// DropDelayedWills drops the wills waiting for their Will Delay Interval,
+// and those of connections closing later on, so none is published once
+// the server is stopped.
+func (s *Server) DropDelayedWills() {
+	s.connsMu.Lock()
+	wills := s.wills
+	s.wills = nil
+	s.connsMu.Unlock()
+
+	for _, dw := range wills {
+		dw.timer.Stop()
+	}
+}
+
+// sendWill publishes the will of clientID.
+func (s *Server) sendWill(clientID string, will topic.Message, props *protocol.Properties) {
+	log.Printf("publishing will of client %s", clientID)
+	// The expiry interval of a will counts from its publication.
+	will.Expiry = topic.ExpiresAt(props)
+	s.broker.Publish(will)
+}
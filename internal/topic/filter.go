@@ -0,0 +1,59 @@
+package topic
+
+import "strings"
+
+// MatchFilter reports whether the topic name matches the topic filter.
+// The filter may contain the single-level wildcard "+" and the multi-level
+// wildcard "#", which also matches the parent level, so "foo/#" matches
+// "foo" as well as "foo/bar".
+//
+// Topic names starting with '$' are reserved for the server and are not
+// matched by a filter starting with a wildcard.
+func MatchFilter(filter, topic string) bool {
+	if topic != "" && topic[0] == '$' && filter != "" && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	filterLevels := split(filter)
+	topicLevels := split(topic)
+
+	for i, lvl := range filterLevels {
+		if lvl == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if lvl != "+" && lvl != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// ValidFilter reports whether filter is a valid topic filter: it is not
+// empty, "+" only stands for a whole level, and "#" only for the whole
+// last level.
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := split(filter)
+	for i, lvl := range levels {
+		switch {
+		case lvl == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case lvl == "+":
+		case strings.ContainsAny(lvl, "+#"):
+			return false
+		}
+	}
+
+	return true
+}
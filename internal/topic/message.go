@@ -0,0 +1,146 @@
+package topic
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+)
+
+// Message is an application message routed through the tree. Subscribers
+// receive it decoded, and those connected over the network encode it
+// themselves.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+
+	// Properties are nil when the message has none. They are passed on to
+	// subscribers unchanged, except for the Message Expiry Interval, which
+	// is lowered to the time the message has left.
+	Properties *protocol.Properties
+
+	// From is the client identifier of the publisher, empty for messages
+	// published in-process.
+	From string
+
+	// Expiry is when the message expires, from its Message Expiry Interval,
+	// or the zero time if it does not.
+	Expiry time.Time
+
+	// SubscriptionIdentifiers are the identifiers of the subscriptions of
+	// the receiving subscriber that the message matched. They are set for
+	// each delivery and added to the properties of the PUBLISH.
+	SubscriptionIdentifiers []uint32
+
+	frame *sharedFrame
+}
+
+// sharedFrame holds the QoS 0 PUBLISH frames of a message, one per protocol
+// version, each encoded on first use.
+type sharedFrame struct {
+	v311, v5 encodedFrame
+}
+
+type encodedFrame struct {
+	once sync.Once
+	b    []byte
+	err  error
+}
+
+// ShareFrame makes m and every copy of it made afterwards share the frames
+// returned by Frame, so a message delivered to many network clients is only
+// encoded once per protocol version. Copies must keep the topic, payload,
+// retain flag and properties.
+func (m *Message) ShareFrame() {
+	m.frame = &sharedFrame{}
+}
+
+// Frame returns the message encoded as a QoS 0 PUBLISH packet for the given
+// protocol version, with the retain flag of the message. The frame must not
+// be modified. Messages with subscription identifiers, which differ between
+// subscribers, are encoded on every call.
+func (m *Message) Frame(version byte) ([]byte, error) {
+	if m.frame == nil || len(m.SubscriptionIdentifiers) > 0 {
+		return m.encode(version)
+	}
+
+	f := &m.frame.v311
+	if version == protocol.Version5 {
+		f = &m.frame.v5
+	}
+
+	f.once.Do(func() {
+		f.b, f.err = m.encode(version)
+	})
+
+	return f.b, f.err
+}
+
+func (m *Message) encode(version byte) ([]byte, error) {
+	pkt := m.Packet()
+	pkt.QoS = 0
+
+	var buf bytes.Buffer
+	err := protocol.EncodeVersion(&buf, pkt, version)
+
+	return buf.Bytes(), err
+}
+
+// Packet returns the PUBLISH packet carrying the message, without a packet
+// identifier. An expiring message carries the time it has left at that
+// moment, and its subscription identifiers are added to the properties.
+func (m *Message) Packet() *protocol.PublishPacket {
+	pkt := &protocol.PublishPacket{
+		Topic:      m.Topic,
+		Payload:    m.Payload,
+		QoS:        m.QoS,
+		Retain:     m.Retain,
+		Properties: m.Properties,
+	}
+
+	interval := ExpiryInterval(m.Expiry)
+	if interval != nil || len(m.SubscriptionIdentifiers) > 0 {
+		var props protocol.Properties
+		if m.Properties != nil {
+			props = *m.Properties
+		}
+		if interval != nil {
+			props.MessageExpiry = interval
+		}
+		props.SubscriptionIdentifiers = m.SubscriptionIdentifiers
+		pkt.Properties = &props
+	}
+
+	return pkt
+}
+
+// Expired reports whether the message has expired and must not be
+// delivered anymore.
+func (m *Message) Expired() bool {
+	return !m.Expiry.IsZero() && !time.Now().Before(m.Expiry)
+}
+
+// ExpiresAt returns when a message published now with the given properties
+// expires, or the zero time if they have no Message Expiry Interval.
+func ExpiresAt(props *protocol.Properties) time.Time {
+	if props == nil || props.MessageExpiry == nil {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(*props.MessageExpiry) * time.Second)
+}
+
+// ExpiryInterval returns the Message Expiry Interval to send with a message
+// expiring at expiry: the seconds it has left, rounded up, or nil if expiry
+// is the zero time.
+func ExpiryInterval(expiry time.Time) *uint32 {
+	if expiry.IsZero() {
+		return nil
+	}
+
+	left := max(time.Until(expiry), 0)
+	interval := uint32((left + time.Second - 1) / time.Second)
+	return &interval
+}
@@ -0,0 +1,89 @@
+package topic
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// sharePrefix starts the filters of shared subscriptions, in the form
+// "$share/{group}/{filter}".
+const sharePrefix = "$share/"
+
+// ErrInvalidSharedFilter is returned by ParseShared for a "$share/" filter
+// without a group name or a topic filter, or whose group name contains a
+// wildcard.
+var ErrInvalidSharedFilter = errors.New("invalid shared subscription filter")
+
+// ParseShared splits a shared subscription filter into its group name and
+// topic filter. For other filters it returns an empty group and the filter
+// unchanged.
+func ParseShared(filter string) (group, topicFilter string, err error) {
+	rest, ok := strings.CutPrefix(filter, sharePrefix)
+	if !ok {
+		return "", filter, nil
+	}
+
+	group, topicFilter, ok = strings.Cut(rest, "/")
+	if !ok || group == "" || topicFilter == "" || strings.ContainsAny(group, "+#") {
+		return "", "", ErrInvalidSharedFilter
+	}
+
+	return group, topicFilter, nil
+}
+
+// SharedGroup is a shared subscription: the subscribers that joined the
+// same group with the same topic filter. Each message matching the filter
+// is meant for only one of them.
+type SharedGroup struct {
+	Name string
+
+	// Members are sorted by subscriber ID. The slice is replaced, never
+	// modified, when the membership changes, so it is safe to read while
+	// the tree is updated.
+	Members []Subscription
+
+	// counter survives the copies of the tree, so that a strategy cycling
+	// through the members is not restarted by every subscription change.
+	counter *atomic.Uint64
+}
+
+// Next returns the next value of a counter kept for the group across tree
+// copies, starting at 0.
+func (g *SharedGroup) Next() uint64 {
+	return g.counter.Add(1) - 1
+}
+
+// join returns a copy of g with sub as a member, replacing the previous
+// subscription of the same subscriber, and reports whether sub is a new
+// member.
+func (g *SharedGroup) join(sub Subscription) (*SharedGroup, bool) {
+	id := sub.Subscriber.ID()
+	i, found := slices.BinarySearchFunc(g.Members, id, compareID)
+
+	members := slices.Clone(g.Members)
+	if found {
+		members[i] = sub
+	} else {
+		members = slices.Insert(members, i, sub)
+	}
+
+	return &SharedGroup{Name: g.Name, Members: members, counter: g.counter}, !found
+}
+
+// leave returns a copy of g without the subscriber clientID, and reports
+// whether it was a member.
+func (g *SharedGroup) leave(clientID string) (*SharedGroup, bool) {
+	i, found := slices.BinarySearchFunc(g.Members, clientID, compareID)
+	if !found {
+		return g, false
+	}
+
+	members := slices.Delete(slices.Clone(g.Members), i, i+1)
+	return &SharedGroup{Name: g.Name, Members: members, counter: g.counter}, true
+}
+
+func compareID(sub Subscription, id string) int {
+	return strings.Compare(sub.Subscriber.ID(), id)
+}
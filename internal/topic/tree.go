@@ -1,36 +1,81 @@
 package topic
 
+import "sync/atomic"
+
 type Tree struct {
 	root *node
 }
 
 type node struct {
 	children map[string]*node
-	subs     map[string]Subscriber
+	subs     map[string]Subscription
+
+	// groups holds the shared subscriptions to the node's filter by group
+	// name. It is nil until the first one is added.
+	groups map[string]*SharedGroup
 }
 
+// Subscriber receives the messages published to the filters it is
+// subscribed to. Its ID identifies it in the tree, so subscribing again
+// with the same ID replaces the previous subscription to a filter.
 type Subscriber interface {
 	ID() string
-	Enqueue([]byte) error
+
+	// Deliver hands a message to the subscriber. Its QoS has already been
+	// downgraded to the maximum granted to the subscription. Deliver must
+	// not block, as it runs on the publisher's goroutine.
+	Deliver(msg Message) error
+}
+
+// Subscription is a Subscriber attached to a topic filter, together with
+// the maximum QoS level granted to it for that filter and its MQTT 5
+// subscription options. The zero options behave like MQTT 3.1.1.
+type Subscription struct {
+	Subscriber Subscriber
+	QoS        byte
+
+	// NoLocal keeps the messages published by the subscriber itself, whose
+	// From is its ID, from being delivered to it.
+	NoLocal bool
+
+	// RetainAsPublished delivers messages with the RETAIN flag they were
+	// published with, instead of clearing it.
+	RetainAsPublished bool
+
+	// RetainHandling tells when retained messages are sent to the
+	// subscription: 0 on every subscribe, 1 only when the subscription is
+	// new, 2 never.
+	RetainHandling byte
+
+	// Identifier is the subscription identifier given by an MQTT 5 client,
+	// or 0 if there is none.
+	Identifier uint32
 }
 
 func NewTree() *Tree {
 	return &Tree{
 		root: &node{
 			children: make(map[string]*node),
-			subs:     make(map[string]Subscriber),
+			subs:     make(map[string]Subscription),
 		},
 	}
 }
 
-// Subscribe adds a client to the tree's subscription list.
+// Subscribe adds a subscription to the tree's subscription list.
 // It will receive all messages published to topics that match the filter.
 // The filter string is a topic name, or a topic name with a single-level or
 // multi-level wildcard. For example: "foo/bar", "foo/+", "foo/#".
 // A client can subscribe to multiple topics by calling Subscribe multiple times.
 // If a client is already subscribed to a topic, calling Subscribe again will not
-// cause the client to receive duplicate messages.
-func (t *Tree) Subscribe(filter string, sub Subscriber) {
+// cause the client to receive duplicate messages; the QoS and options of the
+// existing subscription are replaced instead. Subscribe reports whether the
+// subscription is new.
+//
+// A filter of the form "$share/{group}/{filter}" adds s to a shared
+// subscription instead, see MatchAll. Filters rejected by ParseShared are
+// taken literally.
+func (t *Tree) Subscribe(filter string, s Subscription) bool {
+	group, filter := sharedFilter(filter)
 	levels := split(filter)
 
 	cur := t.root
@@ -38,13 +83,28 @@ func (t *Tree) Subscribe(filter string, sub Subscriber) {
 		if cur.children[lvl] == nil {
 			cur.children[lvl] = &node{
 				children: make(map[string]*node),
-				subs:     make(map[string]Subscriber),
+				subs:     make(map[string]Subscription),
 			}
 		}
 		cur = cur.children[lvl]
 	}
 
-	cur.subs[sub.ID()] = sub
+	if group == "" {
+		_, exists := cur.subs[s.Subscriber.ID()]
+		cur.subs[s.Subscriber.ID()] = s
+		return !exists
+	}
+
+	g := cur.groups[group]
+	if g == nil {
+		g = &SharedGroup{Name: group, counter: new(atomic.Uint64)}
+	}
+	if cur.groups == nil {
+		cur.groups = make(map[string]*SharedGroup)
+	}
+	g, joined := g.join(s)
+	cur.groups[group] = g
+	return joined
 }
 
 // Clone returns a deep copy of the tree. It is used by the
@@ -56,30 +116,83 @@ func (t *Tree) Clone() *Tree {
 	}
 }
 
-// Match returns a list of subscribers that are subscribed to the given topic.
+// Match returns a list of subscriptions whose filter matches the given topic.
 // The topic string can contain single-level or multi-level wildcards.
 // For example, "foo/bar", "foo/+", "foo/#".
 // If no subscribers match the given topic, an empty list is returned.
-func (t *Tree) Match(topic string) []Subscriber {
-	subs := subsPool.Get().([]Subscriber)
+// Shared subscriptions are left out.
+func (t *Tree) Match(topic string) []Subscription {
+	subs := subsPool.Get().([]Subscription)
 	subs = subs[:0]
 
-	t.match(t.root, topic, 0, &subs)
+	t.match(t.root, topic, 0, &subs, nil)
 	return subs
 }
 
-// PutSubs returns a slice of Subscribers to the subsPool, to be reused
+// MatchAll is like Match, but also returns the shared subscriptions whose
+// filter matches the topic. The caller picks the member of each group that
+// receives the message. A group subscribed with several matching filters
+// is returned once per filter.
+func (t *Tree) MatchAll(topic string) ([]Subscription, []*SharedGroup) {
+	subs := subsPool.Get().([]Subscription)
+	subs = subs[:0]
+
+	var groups []*SharedGroup
+	t.match(t.root, topic, 0, &subs, &groups)
+	return subs, groups
+}
+
+// PutSubs returns a slice of Subscriptions to the subsPool, to be reused
 // by the Match function. It is used to avoid unnecessary memory allocations
 // when the Match function is called with a large number of subscribers.
 // If the capacity of the slice is greater than 1024, the slice is not returned to
 // the pool, as it is unlikely to be reused.
-func PutSubs(subs []Subscriber) {
+func PutSubs(subs []Subscription) {
 	if cap(subs) > 1024 {
 		return
 	}
 	subsPool.Put(subs[:0])
 }
 
+// Unsubscribe removes the subscription of the given clientID to exactly the
+// given filter. Subscriptions to other filters, including overlapping
+// wildcard filters, are left untouched. Nodes that no longer hold any
+// subscription are pruned from the tree.
+//
+// It reports whether the client was subscribed to the filter. Shared
+// subscriptions are left with the same "$share/{group}/{filter}" filter
+// they were made with.
+func (t *Tree) Unsubscribe(filter string, clientID string) bool {
+	group, filter := sharedFilter(filter)
+	levels := split(filter)
+
+	path := make([]*node, 0, len(levels)+1)
+	cur := t.root
+	path = append(path, cur)
+
+	for _, lvl := range levels {
+		cur = cur.children[lvl]
+		if cur == nil {
+			return false
+		}
+		path = append(path, cur)
+	}
+
+	if !cur.remove(group, clientID) {
+		return false
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		n := path[i+1]
+		if len(n.subs) > 0 || len(n.children) > 0 || len(n.groups) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+
+	return true
+}
+
 // UnsubscribeAll removes all subscriptions for the given clientID from the tree.
 // It is used by the Broker's UnsubscribeAll function to remove all subscriptions
 // for a client when the client disconnects.
@@ -92,7 +205,7 @@ func (t *Tree) UnsubscribeAll(clientID string) {
 func (n *node) clone() *node {
 	nn := &node{
 		children: make(map[string]*node, len(n.children)),
-		subs:     make(map[string]Subscriber, len(n.subs)),
+		subs:     make(map[string]Subscription, len(n.subs)),
 	}
 
 	for k, v := range n.children {
@@ -103,28 +216,77 @@ func (n *node) clone() *node {
 		nn.subs[id] = sub
 	}
 
+	if n.groups != nil {
+		nn.groups = make(map[string]*SharedGroup, len(n.groups))
+		for name, g := range n.groups {
+			nn.groups[name] = g
+		}
+	}
+
 	return nn
 }
 
-// match is a helper function that returns a list of subscribers that are
-// subscribed to the given topic. It is used by the Match function to
+// remove removes the subscription of clientID to the node's filter, from
+// the shared subscription of group if it is not empty. It reports whether
+// there was one.
+func (n *node) remove(group, clientID string) bool {
+	if group == "" {
+		if _, ok := n.subs[clientID]; !ok {
+			return false
+		}
+		delete(n.subs, clientID)
+		return true
+	}
+
+	g, ok := n.groups[group]
+	if !ok {
+		return false
+	}
+
+	g, ok = g.leave(clientID)
+	if !ok {
+		return false
+	}
+
+	if len(g.Members) == 0 {
+		delete(n.groups, group)
+	} else {
+		n.groups[group] = g
+	}
+	return true
+}
+
+// collect appends the subscriptions of the node to out, and its shared
+// subscriptions to groups unless it is nil.
+func (n *node) collect(out *[]Subscription, groups *[]*SharedGroup) {
+	for _, sub := range n.subs {
+		*out = append(*out, sub)
+	}
+
+	if groups == nil {
+		return
+	}
+	for _, g := range n.groups {
+		*groups = append(*groups, g)
+	}
+}
+
+// match is a helper function that returns a list of subscriptions that
+// match the given topic. It is used by the Match function to
 // recursively traverse the tree and find matching subscribers.
 //
 // The function takes a node, a slice of strings representing the topic
-// levels, and a slice of Subscribers to store the matching subscribers.
-func (t *Tree) match(n *node, topic string, idx int, out *[]Subscriber) {
+// levels, and a slice of Subscriptions to store the matching subscriptions.
+// Shared subscriptions are stored in groups, unless it is nil.
+func (t *Tree) match(n *node, topic string, idx int, out *[]Subscription, groups *[]*SharedGroup) {
 	if n == nil {
 		return
 	}
 
 	if idx >= len(topic) {
-		for _, sub := range n.subs {
-			*out = append(*out, sub)
-		}
+		n.collect(out, groups)
 		if hash := n.children["#"]; hash != nil {
-			for _, sub := range hash.subs {
-				*out = append(*out, sub)
-			}
+			hash.collect(out, groups)
 		}
 		return
 	}
@@ -144,16 +306,20 @@ func (t *Tree) match(n *node, topic string, idx int, out *[]Subscriber) {
 	}
 
 	// exact match
-	t.match(n.children[level], topic, nextIdx, out)
+	t.match(n.children[level], topic, nextIdx, out, groups)
+
+	// Topics starting with '$' are not matched by a wildcard in the first
+	// level, as in MatchFilter.
+	if idx == 0 && topic[0] == '$' {
+		return
+	}
 
 	// '+'
-	t.match(n.children["+"], topic, nextIdx, out)
+	t.match(n.children["+"], topic, nextIdx, out, groups)
 
 	// '#'
 	if hash := n.children["#"]; hash != nil {
-		for _, sub := range hash.subs {
-			*out = append(*out, sub)
-		}
+		hash.collect(out, groups)
 	}
 }
 
@@ -167,11 +333,26 @@ func (t *Tree) unsubscribeAll(n *node, clientID string) {
 
 	delete(n.subs, clientID)
 
+	for name := range n.groups {
+		n.remove(name, clientID)
+	}
+
 	for _, child := range n.children {
 		t.unsubscribeAll(child, clientID)
 	}
 }
 
+// sharedFilter returns the group and topic filter of a shared subscription
+// filter, or an empty group and the filter itself for other filters and
+// invalid shared ones.
+func sharedFilter(filter string) (group, topicFilter string) {
+	group, topicFilter, err := ParseShared(filter)
+	if err != nil {
+		return "", filter
+	}
+	return group, topicFilter
+}
+
 // split takes a string and splits it into a slice of strings using the '/' character
 // as a delimiter. It returns a slice of strings containing the split parts of the
 // original string. For example, the string "foo/bar" would be split into the slice
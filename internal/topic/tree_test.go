@@ -0,0 +1,196 @@
+package topic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSub struct {
+	id string
+}
+
+func (s *stubSub) ID() string {
+	return s.id
+}
+
+func (s *stubSub) Deliver(_ Message) error {
+	return nil
+}
+
+func matchIDs(t *Tree, topic string) []string {
+	subs := t.Match(topic)
+	defer PutSubs(subs)
+
+	ids := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		ids = append(ids, sub.Subscriber.ID())
+	}
+	return ids
+}
+
+func TestTreeUnsubscribe(t *testing.T) {
+	tree := NewTree()
+	a := &stubSub{id: "a"}
+	b := &stubSub{id: "b"}
+
+	tree.Subscribe("sensors/+/temp", Subscription{Subscriber: a, QoS: 0})
+	tree.Subscribe("sensors/#", Subscription{Subscriber: a, QoS: 0})
+	tree.Subscribe("sensors/+/temp", Subscription{Subscriber: b, QoS: 0})
+
+	require.True(t, tree.Unsubscribe("sensors/+/temp", "a"))
+	assert.ElementsMatch(t, []string{"a", "b"}, matchIDs(tree, "sensors/1/temp"))
+
+	require.True(t, tree.Unsubscribe("sensors/#", "a"))
+	assert.ElementsMatch(t, []string{"b"}, matchIDs(tree, "sensors/1/temp"))
+
+	assert.False(t, tree.Unsubscribe("sensors/#", "a"), "already removed")
+	assert.False(t, tree.Unsubscribe("other/topic", "b"), "unknown filter")
+
+	require.True(t, tree.Unsubscribe("sensors/+/temp", "b"))
+	assert.Empty(t, tree.root.children, "empty nodes are pruned")
+}
+
+func TestTreeDollarTopics(t *testing.T) {
+	tree := NewTree()
+	tree.Subscribe("#", Subscription{Subscriber: &stubSub{id: "all"}})
+	tree.Subscribe("+/uptime", Subscription{Subscriber: &stubSub{id: "plus"}})
+	tree.Subscribe("$SYS/#", Subscription{Subscriber: &stubSub{id: "sys"}})
+
+	assert.ElementsMatch(t, []string{"sys"}, matchIDs(tree, "$SYS/uptime"),
+		"wildcards in the first level do not match $ topics")
+	assert.ElementsMatch(t, []string{"all", "plus"}, matchIDs(tree, "app/uptime"))
+}
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/temp", "sensors/temp", true},
+		{"sensors/temp", "sensors/hum", false},
+		{"sensors/+", "sensors/temp", true},
+		{"sensors/+", "sensors/temp/1", false},
+		{"sensors/+/1", "sensors/temp/1", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/temp/1", true},
+		{"#", "sensors/temp", true},
+		{"+/+", "/finance", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, MatchFilter(tt.filter, tt.topic), "%s vs %s", tt.filter, tt.topic)
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"sensors/temp", true},
+		{"sensors/+/temp", true},
+		{"sensors/#", true},
+		{"#", true},
+		{"+", true},
+		{"/", true},
+		{"", false},
+		{"sensors/#/temp", false},
+		{"sensors#", false},
+		{"sensors/temp+", false},
+		{"+sensors", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ValidFilter(tt.filter), tt.filter)
+	}
+}
+
+func TestParseShared(t *testing.T) {
+	tests := []struct {
+		filter      string
+		group       string
+		topicFilter string
+		wantErr     bool
+	}{
+		{filter: "sensors/#", topicFilter: "sensors/#"},
+		{filter: "$share/workers/jobs/+", group: "workers", topicFilter: "jobs/+"},
+		{filter: "$share/workers/#", group: "workers", topicFilter: "#"},
+		{filter: "$share/workers", wantErr: true},
+		{filter: "$share/workers/", wantErr: true},
+		{filter: "$share//jobs", wantErr: true},
+		{filter: "$share/+/jobs", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		group, topicFilter, err := ParseShared(tt.filter)
+		if tt.wantErr {
+			assert.ErrorIs(t, err, ErrInvalidSharedFilter, tt.filter)
+			continue
+		}
+		require.NoError(t, err, tt.filter)
+		assert.Equal(t, tt.group, group, tt.filter)
+		assert.Equal(t, tt.topicFilter, topicFilter, tt.filter)
+	}
+}
+
+func TestTreeSharedSubscriptions(t *testing.T) {
+	tree := NewTree()
+	a := &stubSub{id: "a"}
+	b := &stubSub{id: "b"}
+	c := &stubSub{id: "c"}
+
+	tree.Subscribe("$share/workers/jobs/+", Subscription{Subscriber: b, QoS: 1})
+	tree.Subscribe("$share/workers/jobs/+", Subscription{Subscriber: a, QoS: 1})
+	tree.Subscribe("$share/audit/jobs/#", Subscription{Subscriber: c, QoS: 0})
+	tree.Subscribe("jobs/+", Subscription{Subscriber: c, QoS: 0})
+
+	subs, groups := tree.MatchAll("jobs/1")
+	defer PutSubs(subs)
+
+	require.Len(t, subs, 1, "shared subscriptions are matched as groups")
+	assert.Equal(t, "c", subs[0].Subscriber.ID())
+	assert.Equal(t, []string{"c"}, matchIDs(tree, "jobs/1"), "Match leaves groups out")
+
+	require.Len(t, groups, 2)
+	byName := map[string]*SharedGroup{}
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+	require.Contains(t, byName, "workers")
+	members := byName["workers"].Members
+	require.Len(t, members, 2)
+	assert.Equal(t, "a", members[0].Subscriber.ID(), "members are sorted by ID")
+	assert.Equal(t, "b", members[1].Subscriber.ID())
+
+	// The counter of a group survives copies of the tree.
+	assert.Equal(t, uint64(0), byName["workers"].Next())
+	clone := tree.Clone()
+	clone.Subscribe("$share/workers/jobs/+", Subscription{Subscriber: c, QoS: 1})
+	_, groups = clone.MatchAll("jobs/1")
+	for _, g := range groups {
+		if g.Name == "workers" {
+			assert.Len(t, g.Members, 3)
+			assert.Equal(t, uint64(1), g.Next())
+		}
+	}
+	assert.Len(t, members, 2, "the original tree is unchanged")
+
+	assert.False(t, tree.Unsubscribe("jobs/+", "a"), "not a plain subscriber")
+	require.True(t, tree.Unsubscribe("$share/workers/jobs/+", "a"))
+	require.True(t, tree.Unsubscribe("$share/workers/jobs/+", "b"))
+	require.True(t, tree.Unsubscribe("jobs/+", "c"))
+
+	_, groups = tree.MatchAll("jobs/1")
+	require.Len(t, groups, 1)
+	assert.Equal(t, "audit", groups[0].Name)
+
+	tree.UnsubscribeAll("c")
+	_, groups = tree.MatchAll("jobs/1")
+	assert.Empty(t, groups)
+}
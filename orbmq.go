@@ -0,0 +1,403 @@
+// Package orbmq embeds an OrbMQ MQTT broker in a Go program.
+//
+// A Server owns its own broker state, so several independent instances can
+// run in the same process. Besides serving MQTT clients over TCP, it lets
+// the host program publish messages and subscribe to topics in-process.
+package orbmq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/broker"
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/server"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+var (
+	// ErrBadCredentials is returned by an Authenticate hook when the username
+	// or password is wrong. The client is refused with return code 0x04,
+	// or reason code 0x86 for MQTT 5 clients.
+	ErrBadCredentials = server.ErrBadCredentials
+
+	// ErrNotAuthorized is returned by an Authenticate hook when the client is
+	// not allowed to connect. The client is refused with return code 0x05,
+	// or reason code 0x87 for MQTT 5 clients.
+	ErrNotAuthorized = server.ErrNotAuthorized
+
+	// ErrServerStarted is returned by Start when the server was already
+	// started.
+	ErrServerStarted = errors.New("server already started")
+
+	// ErrServerClosed is returned by operations on a server after Shutdown.
+	ErrServerClosed = errors.New("server closed")
+
+	// ErrInvalidTopic is returned by Publish for a topic name that is empty
+	// or contains a wildcard, and by Subscribe for an invalid topic filter.
+	ErrInvalidTopic = errors.New("invalid topic")
+)
+
+// Listener is a TCP address the server accepts MQTT connections on, with
+// an optional packet size limit of its own.
+type Listener = server.Listener
+
+// ClientInfo describes a connected client.
+type ClientInfo = server.ClientInfo
+
+// ConnectInfo holds the fields of a CONNECT packet an Authenticate hook
+// decides on. Username and Password are empty when the client did not
+// send them.
+type ConnectInfo struct {
+	ClientID string
+	Username string
+	Password string
+}
+
+// Options configures a Server. The zero value is a server without
+// listeners, which is only reachable in-process.
+type Options struct {
+	// Listeners are the TCP addresses the server accepts connections on.
+	// Use port 0 to let the system pick one; Addrs reports the result.
+	Listeners []Listener
+
+	// MaxPacketSize limits the size of packets accepted from clients,
+	// fixed header included. Listeners may override it. Zero only applies
+	// the protocol limit of 256 MB.
+	MaxPacketSize int
+
+	// MaxKeepAlive caps the keep-alive interval of clients, and
+	// KeepAliveOverride replaces it altogether. Zero disables either.
+	MaxKeepAlive      time.Duration
+	KeepAliveOverride time.Duration
+
+	// MaxSessionExpiry caps the time a session is kept after its client
+	// disconnects, whatever session expiry interval the client asks for.
+	// Persistent MQTT 3.1.1 sessions are kept that long as well. Zero keeps
+	// sessions for as long as clients ask.
+	MaxSessionExpiry time.Duration
+
+	// TopicAliasMaximum is the number of topic aliases an MQTT 5 client may
+	// define for the messages it publishes. Zero keeps the default of 64,
+	// and a negative value disables inbound topic aliases.
+	TopicAliasMaximum int
+
+	// ReceiveMaximum is the number of QoS 2 messages an MQTT 5 client may
+	// publish before releasing them. Zero keeps the default of 1024.
+	ReceiveMaximum int
+
+	// SharedStrategy selects the member of a shared subscription group,
+	// subscribed to as "$share/{group}/{filter}", that receives each
+	// message. It defaults to SharedRoundRobin.
+	SharedStrategy SharedStrategy
+
+	// ClientIDPrefix starts the identifiers assigned to clients connecting
+	// with an empty ClientID. It defaults to "orbmq-".
+	ClientIDPrefix string
+
+	// Authenticate, when set, is called for every CONNECT. Returning nil
+	// accepts the client; ErrBadCredentials refuses it as a bad username
+	// or password and any other error as not authorized.
+	Authenticate func(info ConnectInfo) error
+}
+
+// SharedStrategy selects the member of a shared subscription group that
+// receives a message.
+type SharedStrategy = broker.SharedStrategy
+
+// Shared subscription strategies.
+const (
+	// SharedRoundRobin hands messages to the members of a group in turn.
+	SharedRoundRobin = broker.SharedRoundRobin
+
+	// SharedRandom picks a member at random for every message.
+	SharedRandom = broker.SharedRandom
+
+	// SharedSticky sends all the messages of a publishing client to the same
+	// member while the group does not change.
+	SharedSticky = broker.SharedSticky
+
+	// SharedLeastQueue picks the member with the fewest messages waiting.
+	SharedLeastQueue = broker.SharedLeastQueue
+)
+
+// Properties are the MQTT 5 properties of a message, such as its content
+// type or user properties. They reach in-process subscribers unchanged.
+type Properties = protocol.Properties
+
+// UserProperty is an application-defined name and value pair.
+type UserProperty = protocol.UserProperty
+
+// Message is an application message published or received in-process.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+
+	// Properties are nil when the message has none.
+	Properties *Properties
+}
+
+// fromTopic converts a message delivered by the broker.
+func fromTopic(msg topic.Message) Message {
+	return Message{
+		Topic:      msg.Topic,
+		Payload:    msg.Payload,
+		QoS:        msg.QoS,
+		Retain:     msg.Retain,
+		Properties: msg.Properties,
+	}
+}
+
+// MessageHandler is called with the messages matching an in-process
+// subscription.
+type MessageHandler func(msg Message)
+
+// Server is an embeddable MQTT broker.
+type Server struct {
+	opts   Options
+	broker *broker.Broker
+	srv    *server.Server
+
+	// nextSub numbers in-process subscriptions, which have their own
+	// subscriber identifier in the topic tree.
+	nextSub atomic.Uint64
+
+	mu      sync.Mutex
+	started bool
+	closed  bool
+	lns     []net.Listener
+	cancel  context.CancelFunc
+	serving sync.WaitGroup
+	subs    map[*Subscription]struct{}
+}
+
+// New returns a server configured with opts. It does not accept
+// connections until Start is called, but in-process Publish and Subscribe
+// work right away.
+func New(opts Options) *Server {
+	b := broker.New(broker.WithSharedStrategy(opts.SharedStrategy))
+
+	var srvOpts []server.Option
+	if opts.Authenticate != nil {
+		srvOpts = append(srvOpts, server.WithAuthenticator(authenticator(opts.Authenticate)))
+	}
+	if opts.ClientIDPrefix != "" {
+		srvOpts = append(srvOpts, server.WithClientIDPrefix(opts.ClientIDPrefix))
+	}
+	if opts.MaxKeepAlive > 0 {
+		srvOpts = append(srvOpts, server.WithMaxKeepAlive(opts.MaxKeepAlive))
+	}
+	if opts.KeepAliveOverride > 0 {
+		srvOpts = append(srvOpts, server.WithKeepAliveOverride(opts.KeepAliveOverride))
+	}
+	switch {
+	case opts.TopicAliasMaximum > 0:
+		srvOpts = append(srvOpts, server.WithTopicAliasMaximum(uint16(min(opts.TopicAliasMaximum, 65535))))
+	case opts.TopicAliasMaximum < 0:
+		srvOpts = append(srvOpts, server.WithTopicAliasMaximum(0))
+	}
+	if opts.ReceiveMaximum > 0 {
+		srvOpts = append(srvOpts, server.WithReceiveMaximum(uint16(min(opts.ReceiveMaximum, 65535))))
+	}
+	if opts.MaxSessionExpiry > 0 {
+		srvOpts = append(srvOpts, server.WithMaxSessionExpiry(opts.MaxSessionExpiry))
+	}
+	if opts.MaxPacketSize > 0 {
+		srvOpts = append(srvOpts, server.WithMaxPacketSize(opts.MaxPacketSize))
+	}
+
+	return &Server{
+		opts:   opts,
+		broker: b,
+		srv:    server.New("", b, srvOpts...),
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// authenticator adapts an Authenticate hook to the server's Authenticator.
+func authenticator(hook func(ConnectInfo) error) server.Authenticator {
+	return server.AuthenticatorFunc(func(connect *protocol.ConnectPacket) error {
+		info := ConnectInfo{ClientID: connect.ClientID}
+		if connect.Username != nil {
+			info.Username = *connect.Username
+		}
+		if connect.Password != nil {
+			info.Password = *connect.Password
+		}
+		return hook(info)
+	})
+}
+
+// Start binds every listener and serves connections in the background. It
+// returns once the listeners are bound, or the first error binding one.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.closed:
+		return ErrServerClosed
+	case s.started:
+		return ErrServerStarted
+	}
+
+	lns := make([]net.Listener, 0, len(s.opts.Listeners))
+	for _, l := range s.opts.Listeners {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", l.Addr, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i, ln := range lns {
+		maxPacketSize := s.opts.Listeners[i].MaxPacketSize
+		s.serving.Go(func() {
+			_ = s.srv.ServeLimit(ctx, ln, maxPacketSize)
+		})
+	}
+
+	s.started = true
+	s.lns = lns
+	s.cancel = cancel
+	return nil
+}
+
+// Addrs returns the addresses the server listens on, in the order of
+// Options.Listeners, once it has been started.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, len(s.lns))
+	for i, ln := range s.lns {
+		addrs[i] = ln.Addr()
+	}
+
+	return addrs
+}
+
+// Shutdown stops accepting connections, closes the connections of every
+// client and ends the in-process subscriptions. It waits for the
+// connections to be torn down, wills included, until ctx is done. Wills
+// waiting for their Will Delay Interval are dropped, so none of them is
+// published after Shutdown returns.
+//
+// The server cannot be started again afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+
+	for sub := range subs {
+		sub.stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.srv.DropDelayedWills()
+	return err
+}
+
+// Clients returns the clients currently connected over the network.
+func (s *Server) Clients() []ClientInfo {
+	return s.srv.Clients()
+}
+
+// Publish publishes a message to the subscribers of its topic, network
+// clients and in-process subscriptions alike, as if a client had sent it.
+// A MessageExpiry property bounds the time the message stays retained or
+// queued for offline clients. The payload is copied, so the caller may
+// reuse it once Publish returns.
+func (s *Server) Publish(msg Message) error {
+	if msg.QoS > 2 {
+		return errors.New("invalid QoS level")
+	}
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") {
+		return ErrInvalidTopic
+	}
+	if s.isClosed() {
+		return ErrServerClosed
+	}
+
+	s.broker.Publish(topic.Message{
+		Topic:      msg.Topic,
+		Payload:    bytes.Clone(msg.Payload),
+		QoS:        msg.QoS,
+		Retain:     msg.Retain,
+		Properties: msg.Properties,
+		Expiry:     topic.ExpiresAt(msg.Properties),
+	})
+	return nil
+}
+
+// Subscribe subscribes handler to the topic filter. Retained messages
+// matching the filter are passed to it right away. A "$share/{group}/"
+// prefix joins a shared subscription, whose messages are spread over the
+// members of the group.
+//
+// Each subscription runs its handler on a goroutine of its own, one message
+// at a time. Messages arriving faster than the handler returns are queued,
+// and dropped once the queue is full, like for a slow network client.
+func (s *Server) Subscribe(filter string, handler MessageHandler) (*Subscription, error) {
+	if _, topicFilter, err := topic.ParseShared(filter); err != nil || !topic.ValidFilter(topicFilter) {
+		return nil, ErrInvalidTopic
+	}
+
+	id := server.ReservedClientIDPrefix + strconv.FormatUint(s.nextSub.Add(1), 10)
+	sub := newSubscription(s, id, filter, handler)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+
+	go sub.run()
+	s.broker.Subscribe(filter, sub, 2)
+
+	return sub, nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
@@ -0,0 +1,280 @@
+package orbmq
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lucasmendoncca/OrbMQ/client"
+	"github.com/lucasmendoncca/OrbMQ/internal/protocol"
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// start runs a server listening on a random local port and shuts it down
+// at the end of the test.
+func start(t *testing.T, opts Options) (*Server, string) {
+	t.Helper()
+
+	opts.Listeners = append(opts.Listeners, Listener{Addr: "127.0.0.1:0"})
+	s := New(opts)
+	require.NoError(t, s.Start())
+	t.Cleanup(func() {
+		assert.NoError(t, s.Shutdown(context.Background()))
+	})
+
+	return s, s.Addrs()[0].String()
+}
+
+func receive(t *testing.T, msgs chan Message) Message {
+	t.Helper()
+
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return Message{}
+	}
+}
+
+func TestInProcessPubSub(t *testing.T) {
+	s, addr := start(t, Options{})
+	ctx := context.Background()
+
+	msgs := make(chan Message, 4)
+	sub, err := s.Subscribe("sensors/#", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+
+	c := client.New(addr)
+	require.NoError(t, c.Connect(ctx))
+	defer c.Disconnect()
+
+	require.NoError(t, c.Publish(ctx, "sensors/temp", []byte("25.3"), 1, false))
+	msg := receive(t, msgs)
+	assert.Equal(t, "sensors/temp", msg.Topic)
+	assert.Equal(t, "25.3", string(msg.Payload))
+	assert.Equal(t, byte(1), msg.QoS)
+
+	fromHost := make(chan client.Message, 1)
+	_, err = c.Subscribe(ctx, "cmd/+", 1, func(msg client.Message) { fromHost <- msg })
+	require.NoError(t, err)
+
+	require.NoError(t, s.Publish(Message{Topic: "cmd/reboot", Payload: []byte("now"), QoS: 1}))
+	select {
+	case msg := <-fromHost:
+		assert.Equal(t, "cmd/reboot", msg.Topic)
+	case <-time.After(2 * time.Second):
+		t.Fatal("network client did not receive the message")
+	}
+
+	sub.Unsubscribe()
+	require.NoError(t, s.Publish(Message{Topic: "sensors/temp", Payload: []byte("x")}))
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message after unsubscribe: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIndependentInstances(t *testing.T) {
+	a, _ := start(t, Options{})
+	b, _ := start(t, Options{})
+
+	require.NoError(t, a.Publish(Message{Topic: "state", Payload: []byte("a"), Retain: true}))
+
+	msgs := make(chan Message, 1)
+	_, err := b.Subscribe("state", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+	require.NoError(t, b.Publish(Message{Topic: "state", Payload: []byte("b")}))
+
+	assert.Equal(t, "b", string(receive(t, msgs).Payload), "retained messages are not shared")
+}
+
+func TestPublishCopiesPayload(t *testing.T) {
+	s, _ := start(t, Options{})
+
+	payload := []byte("on")
+	require.NoError(t, s.Publish(Message{Topic: "state", Payload: payload, Retain: true}))
+	copy(payload, "no")
+
+	msgs := make(chan Message, 1)
+	_, err := s.Subscribe("state", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+	assert.Equal(t, "on", string(receive(t, msgs).Payload), "the caller may reuse the payload")
+}
+
+func TestInvalidTopics(t *testing.T) {
+	s, _ := start(t, Options{})
+
+	for _, filter := range []string{"", "a/#/b", "a+", "$share/g/"} {
+		_, err := s.Subscribe(filter, func(Message) {})
+		assert.ErrorIs(t, err, ErrInvalidTopic, filter)
+	}
+	for _, name := range []string{"", "a/+", "#"} {
+		assert.ErrorIs(t, s.Publish(Message{Topic: name}), ErrInvalidTopic, name)
+	}
+}
+
+func TestReservedClientID(t *testing.T) {
+	s, addr := start(t, Options{})
+	ctx := context.Background()
+
+	msgs := make(chan Message, 1)
+	sub, err := s.Subscribe("sensors/#", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+
+	var refused *client.ConnectError
+	spoof := client.New(addr, client.WithClientID(sub.ID()), client.WithAutoReconnect(false))
+	err = spoof.Connect(ctx)
+	require.ErrorAs(t, err, &refused)
+	assert.Equal(t, byte(0x02), refused.ReturnCode)
+
+	c := client.New(addr)
+	require.NoError(t, c.Connect(ctx))
+	defer c.Disconnect()
+
+	require.NoError(t, c.Publish(ctx, "sensors/temp", []byte("25.3"), 0, false))
+	assert.Equal(t, "25.3", string(receive(t, msgs).Payload), "the in-process subscription is kept")
+}
+
+func TestAuthenticateHook(t *testing.T) {
+	_, addr := start(t, Options{
+		Authenticate: func(info ConnectInfo) error {
+			if info.Username != "gateway" || info.Password != "secret" {
+				return ErrBadCredentials
+			}
+			return nil
+		},
+	})
+
+	var refused *client.ConnectError
+	err := client.New(addr, client.WithCredentials("gateway", "guess")).Connect(context.Background())
+	require.ErrorAs(t, err, &refused)
+	assert.Equal(t, byte(0x04), refused.ReturnCode)
+
+	c := client.New(addr, client.WithCredentials("gateway", "secret"))
+	require.NoError(t, c.Connect(context.Background()))
+	c.Disconnect()
+}
+
+func TestShutdown(t *testing.T) {
+	s := New(Options{Listeners: []Listener{{Addr: "127.0.0.1:0"}}})
+	require.NoError(t, s.Start())
+	assert.ErrorIs(t, s.Start(), ErrServerStarted)
+
+	c := client.New(s.Addrs()[0].String(), client.WithAutoReconnect(false))
+	require.NoError(t, c.Connect(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("client was not disconnected")
+	}
+
+	assert.ErrorIs(t, s.Publish(Message{Topic: "a"}), ErrServerClosed)
+	assert.ErrorIs(t, s.Start(), ErrServerClosed)
+}
+
+func TestInProcessProperties(t *testing.T) {
+	s := New(Options{})
+	defer s.Shutdown(context.Background())
+
+	msgs := make(chan Message, 1)
+	_, err := s.Subscribe("rpc/+", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+
+	props := &Properties{
+		ContentType:     "application/json",
+		ResponseTopic:   "rpc/reply",
+		CorrelationData: []byte{1, 2},
+		UserProperties:  []UserProperty{{Key: "trace", Value: "abc"}},
+	}
+	require.NoError(t, s.Publish(Message{Topic: "rpc/call", Payload: []byte("{}"), Properties: props}))
+
+	assert.Equal(t, props, receive(t, msgs).Properties)
+}
+
+func TestTypedSubscriberReservedClientID(t *testing.T) {
+	s, addr := start(t, Options{})
+
+	msgs := make(chan Message, 1)
+	sub, err := s.Subscribe("rpc/+", func(msg Message) { msgs <- msg })
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, protocol.EncodeVersion(conn, &protocol.ConnectPacket{
+		ProtocolLevel: protocol.Version5,
+		ClientID:      sub.ID(),
+		CleanSession:  true,
+	}, protocol.Version5))
+	r := protocol.NewReader(conn)
+	r.SetVersion(protocol.Version5)
+	pkt, err := r.ReadPacket()
+	require.NoError(t, err)
+	assert.Equal(t, protocol.ReasonClientIdentifierNotValid, pkt.(*protocol.ConnAckPacket).ReturnCode)
+
+	props := &Properties{ContentType: "application/json", CorrelationData: []byte{1}}
+	require.NoError(t, s.Publish(Message{Topic: "rpc/call", Payload: []byte("{}"), Properties: props}))
+
+	assert.Equal(t, props, receive(t, msgs).Properties, "the typed subscriber is kept")
+}
+
+// chanSub is a broker subscriber forwarding every message to a channel,
+// which outlives the in-process subscriptions ended by Shutdown.
+type chanSub chan topic.Message
+
+func (c chanSub) ID() string {
+	return "chan"
+}
+
+func (c chanSub) Deliver(msg topic.Message) error {
+	c <- msg
+	return nil
+}
+
+func TestShutdownDropsDelayedWills(t *testing.T) {
+	s := New(Options{Listeners: []Listener{{Addr: "127.0.0.1:0"}}})
+	require.NoError(t, s.Start())
+
+	wills := make(chanSub, 1)
+	s.broker.Subscribe("status/#", wills, 0)
+
+	conn, err := net.Dial("tcp", s.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	delay, expiry := uint32(1), uint32(60)
+	require.NoError(t, protocol.EncodeVersion(conn, &protocol.ConnectPacket{
+		ProtocolLevel:  protocol.Version5,
+		ClientID:       "dev",
+		CleanSession:   true,
+		Properties:     &protocol.Properties{SessionExpiry: &expiry},
+		WillFlag:       true,
+		WillTopic:      "status/dev",
+		WillMessage:    []byte("lost"),
+		WillProperties: &protocol.Properties{WillDelay: &delay},
+	}, protocol.Version5))
+	r := protocol.NewReader(conn)
+	r.SetVersion(protocol.Version5)
+	_, err = r.ReadPacket()
+	require.NoError(t, err)
+
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	select {
+	case msg := <-wills:
+		t.Fatalf("will published after Shutdown: %+v", msg)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
@@ -0,0 +1,103 @@
+package orbmq
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lucasmendoncca/OrbMQ/internal/topic"
+)
+
+// subscriptionQueueSize is the number of messages an in-process subscription
+// holds while its handler is busy.
+const subscriptionQueueSize = 1024
+
+// errSubscriptionQueueFull is reported to the broker when a message is
+// dropped because the handler of a subscription does not keep up.
+var errSubscriptionQueueFull = errors.New("subscription queue is full")
+
+// Subscription is an in-process subscription created by Server.Subscribe.
+type Subscription struct {
+	server  *Server
+	id      string
+	filter  string
+	handler MessageHandler
+
+	msgs     chan Message
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newSubscription(s *Server, id, filter string, handler MessageHandler) *Subscription {
+	return &Subscription{
+		server:  s,
+		id:      id,
+		filter:  filter,
+		handler: handler,
+		msgs:    make(chan Message, subscriptionQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// Unsubscribe removes the subscription. The handler is not called anymore
+// once Unsubscribe returns, except for a call that is already running.
+func (sub *Subscription) Unsubscribe() {
+	sub.server.broker.Unsubscribe(sub.filter, sub.id)
+
+	sub.server.mu.Lock()
+	delete(sub.server.subs, sub)
+	sub.server.mu.Unlock()
+
+	sub.stop()
+}
+
+// ID implements topic.Subscriber.
+func (sub *Subscription) ID() string {
+	return sub.id
+}
+
+// Deliver implements topic.Subscriber. In-process deliveries cannot be lost
+// on the way, so QoS 1 and QoS 2 messages need no acknowledgement.
+func (sub *Subscription) Deliver(msg topic.Message) error {
+	select {
+	case <-sub.done:
+		return nil
+	default:
+	}
+
+	select {
+	case sub.msgs <- fromTopic(msg):
+		return nil
+	default:
+		return errSubscriptionQueueFull
+	}
+}
+
+// QueueLen returns the number of messages waiting for the handler, which
+// the SharedLeastQueue strategy compares between group members.
+func (sub *Subscription) QueueLen() int {
+	return len(sub.msgs)
+}
+
+// run calls the handler with every queued message until the subscription
+// is stopped.
+func (sub *Subscription) run() {
+	for {
+		select {
+		case msg := <-sub.msgs:
+			select {
+			case <-sub.done:
+				return
+			default:
+				sub.handler(msg)
+			}
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+func (sub *Subscription) stop() {
+	sub.stopOnce.Do(func() {
+		close(sub.done)
+	})
+}